@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+var aclFilename = flag.String("acl", "", "JSON file mapping bearer tokens to permissions; reloaded on SIGHUP")
+
+// Permission is the class of operation an endpoint performs.
+type Permission int
+
+// Permissions checked by Authorize. PermPull covers everything a consumer does to its own subscription.
+const (
+	PermPublish Permission = iota
+	PermPull
+	PermAdmin
+)
+
+// A Grant lists what one token may do. Pull entries are subscription names, or prefixes ending in "*".
+type Grant struct {
+	Publish bool     `json:"publish"`
+	Pull    []string `json:"pull"`
+	Admin   bool     `json:"admin"`
+}
+
+// Allows reports whether the grant permits perm on subscription sub. Admin grants permit everything.
+func (g Grant) Allows(perm Permission, sub string) bool {
+	switch {
+	case g.Admin:
+		return true
+	case perm == PermPublish:
+		return g.Publish
+	case perm == PermPull:
+		for _, pattern := range g.Pull {
+			if pattern == sub || strings.HasSuffix(pattern, "*") && strings.HasPrefix(sub, strings.TrimSuffix(pattern, "*")) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ACL maps bearer tokens, and client certificates as certPrefix plus common name, to grants.
+type ACL map[string]Grant
+
+var acl ACL
+var aclMu = sync.RWMutex{}
+
+// LoadACL reads an ACL file and makes it current.
+func LoadACL(filename string) error {
+	bs, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	var newACL ACL
+	if err := json.Unmarshal(bs, &newACL); err != nil {
+		return fmt.Errorf("parsing %s: %v", filename, err)
+	}
+	aclMu.Lock()
+	defer aclMu.Unlock()
+	acl = newACL
+	return nil
+}
+
+// ReloadACLOnHangup reloads the ACL file whenever the process receives SIGHUP. A file that fails to load leaves the previous ACL in place.
+func ReloadACLOnHangup(filename string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := LoadACL(filename); err != nil {
+				log.Printf("Keeping previous ACL: %v", err)
+				continue
+			}
+			log.Printf("Reloaded ACL from %s", filename)
+		}
+	}()
+}
+
+// bearerToken returns the token from an "Authorization: Bearer" header, or "".
+func bearerToken(r *http.Request) string {
+	const prefix = "Bearer "
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, prefix) {
+		return ""
+	}
+	return strings.TrimPrefix(h, prefix)
+}
+
+// certPrefix marks ACL entries for client certificates, by common name, rather than bearer tokens.
+const certPrefix = "cn:"
+
+// credential returns the ACL key of the request: its bearer token or, without one, certPrefix and the common name of its verified client certificate. A bearer token cannot pose as a certificate.
+func credential(r *http.Request) string {
+	if token := bearerToken(r); token != "" {
+		if strings.HasPrefix(token, certPrefix) {
+			return ""
+		}
+		return token
+	}
+	if cn := ClientCommonName(r); cn != "" {
+		return certPrefix + cn
+	}
+	return ""
+}
+
+// Permits reports whether the request's credential grants perm on subscription sub. Without an ACL everything is permitted.
+func Permits(r *http.Request, perm Permission, sub string) bool {
+	aclMu.RLock()
+	defer aclMu.RUnlock()
+	if acl == nil {
+		return true
+	}
+	grant, ok := acl[credential(r)]
+	return ok && grant.Allows(perm, sub)
+}
+
+// Authorize wraps a handler so it only runs for requests whose credential grants perm. Without an ACL every request is allowed.
+func Authorize(perm Permission, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		aclMu.RLock()
+		current := acl
+		aclMu.RUnlock()
+		if current == nil {
+			h(w, r)
+			return
+		}
+		grant, ok := current[credential(r)]
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, ErrUnauthorized, "missing or unknown bearer token")
+			return
+		}
+		if !parseForm(w, r) {
+			return
+		}
+		if !grant.Allows(perm, r.Form.Get("sub")) {
+			writeError(w, http.StatusForbidden, ErrForbidden, "token does not permit this operation")
+			return
+		}
+		h(w, r)
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientCertificateGrant(t *testing.T) {
+	old := acl
+	acl = ACL{"cn:worker": {Pull: []string{"jobs"}}}
+	defer func() { acl = old }()
+
+	r := httptest.NewRequest("GET", "/pull?sub=jobs&n=1", nil)
+	r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "worker"}}}}}
+	if !Permits(r, PermPull, "jobs") {
+		t.Error("certificate with a granted common name refused")
+	}
+	if Permits(r, PermPublish, "") {
+		t.Error("certificate allowed more than its grant")
+	}
+
+	forged := httptest.NewRequest("GET", "/pull?sub=jobs&n=1", nil)
+	forged.Header.Set("Authorization", "Bearer cn:worker")
+	if Permits(forged, PermPull, "jobs") {
+		t.Error("bearer token posing as a certificate accepted")
+	}
+}
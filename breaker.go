@@ -0,0 +1,73 @@
+package main
+
+import (
+	"flag"
+	"sync"
+	"time"
+)
+
+var breakerThreshold = flag.Int("breaker-threshold", 5, "Consecutive failed sends after which storage writes stop being attempted; 0 disables the breaker")
+var breakerCooldown = flag.Duration("breaker-cooldown", 30*time.Second, "How long the storage breaker stays open before a probe write is allowed")
+
+// Breaker states, as reported by /stats and /healthz.
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+// A CircuitBreaker stops calling a failing dependency after a run of consecutive failures, then lets a single probe call through once a cooldown has passed.
+type CircuitBreaker struct {
+	sync.Mutex
+	Threshold int
+	Cooldown  time.Duration
+	state     string
+	failures  int
+	openedAt  time.Time
+}
+
+// Allow reports whether a call may be attempted. When the cooldown has passed it lets exactly one probe through until that probe's result is recorded, so every call it allows must be followed by Record.
+func (b *CircuitBreaker) Allow() bool {
+	b.Lock()
+	defer b.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		if clock.Now().Sub(b.openedAt) < b.Cooldown {
+			return false
+		}
+		b.state = BreakerHalfOpen
+		return true
+	case BreakerHalfOpen:
+		return false
+	}
+	return true
+}
+
+// Record notes the outcome of a call that Allow let through.
+func (b *CircuitBreaker) Record(err error) {
+	b.Lock()
+	defer b.Unlock()
+	if err == nil {
+		b.state = BreakerClosed
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.state == BreakerHalfOpen || (b.Threshold > 0 && b.failures >= b.Threshold) {
+		b.state = BreakerOpen
+		b.openedAt = clock.Now()
+	}
+}
+
+// State returns the breaker's current state.
+func (b *CircuitBreaker) State() string {
+	b.Lock()
+	defer b.Unlock()
+	if b.state == "" {
+		return BreakerClosed
+	}
+	return b.state
+}
+
+// storageBreaker guards message writes. It is configured from flags in main.
+var storageBreaker = &CircuitBreaker{}
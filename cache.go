@@ -0,0 +1,87 @@
+package main
+
+import (
+	"container/list"
+	"flag"
+	"sync"
+	"sync/atomic"
+)
+
+var cacheBytes = flag.Int64("cache-bytes", 0, "Size of the in-memory cache of message bodies; 0 disables it")
+
+// A MessageCache holds recently read message bodies, evicting the least recently used once their total size exceeds Capacity bytes.
+type MessageCache struct {
+	sync.Mutex
+	Capacity int64
+	Hits     uint64 // Accessed atomically.
+	Misses   uint64 // Accessed atomically.
+	size     int64
+	lru      *list.List // Front is most recently used.
+	items    map[uint64]*list.Element
+}
+
+type cacheEntry struct {
+	id   uint64
+	body string
+}
+
+// NewMessageCache returns an empty cache holding up to capacity bytes of bodies.
+func NewMessageCache(capacity int64) *MessageCache {
+	return &MessageCache{
+		Capacity: capacity,
+		lru:      list.New(),
+		items:    make(map[uint64]*list.Element),
+	}
+}
+
+// Get returns the cached body of message id.
+func (c *MessageCache) Get(id uint64) (string, bool) {
+	if c.Capacity <= 0 {
+		return "", false
+	}
+	c.Lock()
+	defer c.Unlock()
+	e, ok := c.items[id]
+	if !ok {
+		atomic.AddUint64(&c.Misses, 1)
+		return "", false
+	}
+	atomic.AddUint64(&c.Hits, 1)
+	c.lru.MoveToFront(e)
+	return e.Value.(*cacheEntry).body, true
+}
+
+// Add caches the body of message id. Bodies larger than the whole cache are not cached, and nothing is cached when the cache is disabled.
+func (c *MessageCache) Add(id uint64, body string) {
+	if c.Capacity <= 0 || int64(len(body)) > c.Capacity {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.items[id]; ok {
+		return
+	}
+	c.items[id] = c.lru.PushFront(&cacheEntry{id, body})
+	c.size += int64(len(body))
+	for c.size > c.Capacity {
+		c.removeElement(c.lru.Back())
+	}
+}
+
+// Remove drops message id from the cache, if present.
+func (c *MessageCache) Remove(id uint64) {
+	c.Lock()
+	defer c.Unlock()
+	if e, ok := c.items[id]; ok {
+		c.removeElement(e)
+	}
+}
+
+func (c *MessageCache) removeElement(e *list.Element) {
+	entry := c.lru.Remove(e).(*cacheEntry)
+	delete(c.items, entry.id)
+	c.size -= int64(len(entry.body))
+}
+
+// messageCache is sized from the -cache-bytes flag in main.
+var messageCache = NewMessageCache(0)
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// storeBacklog stores n messages of size bytes each and puts them on sub's backlog.
+func storeBacklog(b testing.TB, sub *Subscription, n, size int) {
+	messages := make([]string, n)
+	for i := range messages {
+		messages[i] = strings.Repeat("x", size)
+	}
+	baseID, recipients, _ := CreateMessageIds(n, Routing{Targets: []*Subscription{sub}, RejectBacklog: -1})
+	if err := PutMessages(messages, nil, baseID, recipients); err != nil {
+		b.Fatal(err)
+	}
+}
+
+func TestDisabledCacheHoldsNothing(t *testing.T) {
+	c := NewMessageCache(0)
+	for id := uint64(0); id < 100; id++ {
+		c.Add(id, "")
+	}
+	if len(c.items) != 0 || c.lru.Len() != 0 {
+		t.Errorf("disabled cache holds %d entries", len(c.items))
+	}
+}
+
+// BenchmarkPullCache measures repeated pulls of the same 100 one-kilobyte messages with the message cache off and on.
+func BenchmarkPullCache(b *testing.B) {
+	for _, capacity := range []int64{0, 1 << 20} {
+		b.Run(fmt.Sprintf("cache-bytes=%d", capacity), func(b *testing.B) {
+			setUp(b)
+			old := messageCache
+			messageCache = NewMessageCache(capacity)
+			defer func() { messageCache = old }()
+			sub, _ := CreateSubscription("reader", SubscriptionOptions{})
+			storeBacklog(b, sub, 100, 1024)
+			diskReads := atomic.LoadUint64(&counters.DiskReads)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				ids := FindUnAckedMessageIds(sub, 100)
+				if _, read, _, _, err := GetMessagesWithin(sub, ids, 0, false); err != nil || len(read) != 100 {
+					b.Fatalf("read %d messages, %v", len(read), err)
+				}
+			}
+			b.ReportMetric(float64(atomic.LoadUint64(&counters.DiskReads)-diskReads)/float64(b.N), "disk-reads/op")
+		})
+	}
+}
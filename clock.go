@@ -0,0 +1,30 @@
+package main
+
+import "time"
+
+// A Clock is the source of time for the server: message TTLs, the reaper, the storage breaker's cooldown, signed URL expiry, rate limits, delivery waits and the times reported to clients. Code asks clock rather than the time package, so the clock can be replaced by a fake one that is advanced by hand.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+	Tick(d time.Duration) <-chan time.Time
+}
+
+// A Timer sends the time on C once its duration has passed, unless stopped first. Stop it once it is no longer needed so that it is released at once.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// realClock is the wall clock.
+type realClock struct{}
+
+func (realClock) Now() time.Time                        { return time.Now() }
+func (realClock) NewTimer(d time.Duration) Timer        { return realTimer{time.NewTimer(d)} }
+func (realClock) Tick(d time.Duration) <-chan time.Time { return time.Tick(d) }
+
+type realTimer struct{ *time.Timer }
+
+func (t realTimer) C() <-chan time.Time { return t.Timer.C }
+
+// clock is the Clock used throughout the server.
+var clock Clock = realClock{}
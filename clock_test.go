@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A fakeClock only moves when advanced. Timers and tickers fire as Advance passes their deadlines.
+type fakeClock struct {
+	sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock  *fakeClock
+	c      chan time.Time
+	at     time.Time
+	period time.Duration // Non-zero for a ticker.
+	done   bool          // Fired or stopped, for a timer.
+}
+
+// useFakeClock makes a fake clock the server's clock for the rest of the test.
+func useFakeClock(t testing.TB) *fakeClock {
+	fake := &fakeClock{now: time.Date(2020, 7, 22, 18, 0, 0, 0, time.UTC)}
+	clock = fake
+	t.Cleanup(func() { clock = realClock{} })
+	return fake
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) Timer {
+	return c.add(d, 0)
+}
+
+func (c *fakeClock) Tick(d time.Duration) <-chan time.Time {
+	return c.add(d, d).c
+}
+
+func (c *fakeClock) add(d, period time.Duration) *fakeTimer {
+	c.Lock()
+	defer c.Unlock()
+	t := &fakeTimer{clock: c, c: make(chan time.Time, 1), at: c.now.Add(d), period: period}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance moves the clock on by d, firing every timer and ticker that falls due.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.now = c.now.Add(d)
+	for _, t := range c.timers {
+		for !t.done && !t.at.After(c.now) {
+			select {
+			case t.c <- t.at:
+			default:
+			}
+			if t.period == 0 {
+				t.done = true
+			} else {
+				t.at = t.at.Add(t.period)
+			}
+		}
+	}
+}
+
+// Pending returns how many timers have neither fired nor been stopped.
+func (c *fakeClock) Pending() int {
+	c.Lock()
+	defer c.Unlock()
+	n := 0
+	for _, t := range c.timers {
+		if t.period == 0 && !t.done {
+			n++
+		}
+	}
+	return n
+}
+
+// waitForTimers blocks until n timers are pending, so a goroutine is known to be waiting before the clock is advanced.
+func (c *fakeClock) waitForTimers(t *testing.T, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for c.Pending() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d timers pending, want %d", c.Pending(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.c }
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.Lock()
+	defer t.clock.Unlock()
+	wasPending := !t.done
+	t.done = true
+	return wasPending
+}
+
+func TestDeliveryWatchStopsTimer(t *testing.T) {
+	fake := useFakeClock(t)
+	watch := WatchDelivery(1, 1)
+	NotifyPulled([]uint64{1})
+	if got := watch.Wait(time.Hour); !got[0] {
+		t.Errorf("Wait reported %v, want delivered", got)
+	}
+	if n := fake.Pending(); n != 0 {
+		t.Errorf("%d timers left pending after Wait returned", n)
+	}
+}
+
+func TestDeliveryWatchTimesOut(t *testing.T) {
+	fake := useFakeClock(t)
+	watch := WatchDelivery(1, 2)
+	NotifyPulled([]uint64{2})
+	result := make(chan []bool)
+	go func() { result <- watch.Wait(time.Minute) }()
+	fake.waitForTimers(t, 1)
+	fake.Advance(time.Minute)
+	if got := <-result; got[0] || !got[1] {
+		t.Errorf("Wait reported %v, want only the second message delivered", got)
+	}
+}
+
+func TestAckWatchTimesOut(t *testing.T) {
+	setUp(t)
+	fake := useFakeClock(t)
+	sub, _ := CreateSubscription("late", SubscriptionOptions{})
+	pushAll(sub, 1)
+	watch := WatchAcks(1, 1, []*Subscription{sub})
+	result := make(chan map[string]bool)
+	go func() { result <- watch.Wait(time.Minute) }()
+	fake.waitForTimers(t, 1)
+	fake.Advance(time.Minute)
+	if got := <-result; got["late"] {
+		t.Errorf("Wait reported %v, want late not to have acked", got)
+	}
+	if n := fake.Pending(); n != 0 {
+		t.Errorf("%d timers left pending after Wait returned", n)
+	}
+}
+
+func TestTTLExpiresOnClock(t *testing.T) {
+	setUp(t)
+	fake := useFakeClock(t)
+	sub, _ := CreateSubscription("ttl", SubscriptionOptions{})
+	if err := storeMessages([]string{"short-lived"}, nil, 1); err != nil {
+		t.Fatal(err)
+	}
+	setExpiry(1, fake.Now().Add(time.Minute))
+	pushAll(sub, 1)
+	if ids := FindUnAckedMessageIds(sub, 10); len(ids) != 1 {
+		t.Fatalf("before its TTL the message is not pullable: %v", ids)
+	}
+	fake.Advance(time.Minute)
+	if ids := FindUnAckedMessageIds(sub, 10); len(ids) != 0 {
+		t.Errorf("expired message still pullable: %v", ids)
+	}
+	if n := ReapExpiredMessages(fake.Now()); n != 1 {
+		t.Errorf("reaped %d messages, want 1", n)
+	}
+	if got := sub.Stats().Backlog; got != 0 {
+		t.Errorf("backlog %d after reaping, want 0", got)
+	}
+}
+
+func TestBreakerCooldownOnClock(t *testing.T) {
+	fake := useFakeClock(t)
+	b := &CircuitBreaker{Threshold: 1, Cooldown: 30 * time.Second}
+	b.Record(errors.New("disk on fire"))
+	if b.Allow() {
+		t.Fatal("open breaker allowed a call")
+	}
+	fake.Advance(29 * time.Second)
+	if b.Allow() {
+		t.Fatal("breaker allowed a call before its cooldown")
+	}
+	fake.Advance(time.Second)
+	if !b.Allow() || b.State() != BreakerHalfOpen {
+		t.Errorf("after the cooldown, state %s, want a half-open probe", b.State())
+	}
+}
+
+func TestEmptyBatchLeavesBreakerOpen(t *testing.T) {
+	setUp(t)
+	fake := useFakeClock(t)
+	old := storageBreaker
+	storageBreaker = &CircuitBreaker{Threshold: 1, Cooldown: time.Minute}
+	defer func() { storageBreaker = old }()
+	storageBreaker.Record(errors.New("disk on fire"))
+	fake.Advance(time.Minute)
+	if err := storeMessages(nil, nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	if state := storageBreaker.State(); state != BreakerOpen {
+		t.Errorf("after an empty batch the breaker is %s, want still open", state)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+)
+
+var configFilename = flag.String("config", "", "JSON file of flag values, keyed by flag name with underscores (e.g. data_dir)")
+
+// LoadConfig applies the values in a JSON config file to every flag that was not set explicitly on the command line. Unknown keys are logged and ignored, and a null value leaves its flag unset.
+func LoadConfig(filename string) error {
+	bs, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	var values map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(bs))
+	dec.UseNumber() // Keep integers printable as integers for flag.Set.
+	if err := dec.Decode(&values); err != nil {
+		return fmt.Errorf("parsing %s: %v", filename, err)
+	}
+
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	for key, value := range values {
+		name := strings.Replace(key, "_", "-", -1)
+		if name == "config" || flag.Lookup(name) == nil {
+			log.Printf("Ignoring unknown key %q in %s", key, filename)
+			continue
+		}
+		if explicit[name] || value == nil {
+			continue
+		}
+		if err := flag.Set(name, fmt.Sprint(value)); err != nil {
+			return fmt.Errorf("in %s, key %q: %v", filename, key, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfigNullLeavesFlagUnset(t *testing.T) {
+	setUp(t)
+	filename := filepath.Join(*dataDirname, "pubsubd.json")
+	if err := ioutil.WriteFile(filename, []byte(`{"default_rate_limit": null}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadConfig(filename); err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if *defaultRateLimit != 0 {
+		t.Errorf("default-rate-limit is %v, want it left at 0", *defaultRateLimit)
+	}
+}
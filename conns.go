@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"net"
+	"net/http"
+	"sync"
+)
+
+var keepAlives = flag.Bool("keep-alives", true, "Keep client connections open between requests")
+var idleTimeout = flag.Duration("idle-timeout", 0, "How long an idle keep-alive connection is kept open; 0 means no limit")
+
+// ConnStats counts client connections, for /stats. A high Accepted rate next to few requests per connection means clients are not reusing connections.
+type ConnStats struct {
+	Accepted uint64 `json:"accepted"`
+	Active   int    `json:"active"` // Connections with a request in progress.
+	Idle     int    `json:"idle"`   // Connections waiting for their next request, including new ones.
+}
+
+// ConnTracker follows connection state changes reported to http.Server.ConnState.
+type ConnTracker struct {
+	sync.Mutex
+	states   map[net.Conn]http.ConnState
+	accepted uint64
+}
+
+var connTracker = &ConnTracker{states: make(map[net.Conn]http.ConnState)}
+
+// Track records that c has moved to state. It has the signature of http.Server.ConnState.
+func (t *ConnTracker) Track(c net.Conn, state http.ConnState) {
+	t.Lock()
+	defer t.Unlock()
+	switch state {
+	case http.StateNew:
+		t.accepted++
+		t.states[c] = state
+	case http.StateActive, http.StateIdle:
+		t.states[c] = state
+	case http.StateHijacked, http.StateClosed:
+		delete(t.states, c)
+	}
+}
+
+// Stats counts the connections in each state.
+func (t *ConnTracker) Stats() ConnStats {
+	t.Lock()
+	defer t.Unlock()
+	stats := ConnStats{Accepted: t.accepted}
+	for _, state := range t.states {
+		if state == http.StateActive {
+			stats.Active++
+		} else {
+			stats.Idle++
+		}
+	}
+	return stats
+}
+
+// configureKeepAlives applies the keep-alive flags and connection tracking to server.
+func configureKeepAlives(server *http.Server) {
+	server.IdleTimeout = *idleTimeout
+	server.ConnState = connTracker.Track
+	server.SetKeepAlivesEnabled(*keepAlives)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"flag"
+	"sync"
+	"time"
+)
+
+var maxDeliveryWait = flag.Duration("max-delivery-wait", 30*time.Second, "Longest wait_timeout a /send with wait_for_delivery may ask for")
+
+const defaultDeliveryWait = 5 * time.Second
+
+// deliveryWaiters holds, for each message a sender is waiting on, a channel closed when the message is first pulled.
+var deliveryWaiters = make(map[uint64]chan struct{})
+var deliveryWaitersMu = sync.Mutex{}
+
+// A DeliveryWatch waits for a batch of messages to be pulled.
+type DeliveryWatch struct {
+	ids    []uint64
+	pulled []chan struct{}
+}
+
+// WatchDelivery starts watching the n messages with ids from baseID. It must be called before the messages are delivered so that no pull is missed.
+func WatchDelivery(baseID uint64, n int) *DeliveryWatch {
+	watch := &DeliveryWatch{make([]uint64, n), make([]chan struct{}, n)}
+	deliveryWaitersMu.Lock()
+	defer deliveryWaitersMu.Unlock()
+	for i := range watch.ids {
+		id := baseID + uint64(i)
+		watch.ids[i] = id
+		watch.pulled[i] = make(chan struct{})
+		deliveryWaiters[id] = watch.pulled[i]
+	}
+	return watch
+}
+
+// Wait blocks until every watched message has been pulled or timeout has passed, and reports which were pulled.
+func (watch *DeliveryWatch) Wait(timeout time.Duration) []bool {
+	defer watch.Cancel()
+	timer := clock.NewTimer(timeout)
+	defer timer.Stop()
+	expired := timer.C()
+	delivered := make([]bool, len(watch.pulled))
+	for i, pulled := range watch.pulled {
+		select {
+		case <-pulled:
+			delivered[i] = true
+		case <-expired:
+			for j := i; j < len(watch.pulled); j++ {
+				select {
+				case <-watch.pulled[j]:
+					delivered[j] = true
+				default:
+				}
+			}
+			return delivered
+		}
+	}
+	return delivered
+}
+
+// Cancel stops watching messages that have not been pulled.
+func (watch *DeliveryWatch) Cancel() {
+	deliveryWaitersMu.Lock()
+	defer deliveryWaitersMu.Unlock()
+	for i, id := range watch.ids {
+		if deliveryWaiters[id] == watch.pulled[i] {
+			delete(deliveryWaiters, id)
+		}
+	}
+}
+
+// NotifyPulled wakes senders waiting for any of ids to be pulled.
+func NotifyPulled(ids []uint64) {
+	deliveryWaitersMu.Lock()
+	defer deliveryWaitersMu.Unlock()
+	if len(deliveryWaiters) == 0 {
+		return
+	}
+	for _, id := range ids {
+		if pulled, ok := deliveryWaiters[id]; ok {
+			close(pulled)
+			delete(deliveryWaiters, id)
+		}
+	}
+}
+
+// ackWatches holds, for each message a sender is waiting on with wait_for_all, the watch to tell about its acks.
+var ackWatches = make(map[uint64]*AckWatch)
+var ackWatchesMu = sync.Mutex{}
+
+// An AckWatch waits for every subscription a batch of messages was sent to to ack all of them. Its maps are guarded by ackWatchesMu.
+type AckWatch struct {
+	ids     []uint64
+	pending map[*Subscription]map[uint64]bool // Per subscription, the ids not yet acked.
+	missed  map[*Subscription]bool            // Subscriptions that were never given some of the ids, or dropped them unacked.
+	changed chan struct{}
+}
+
+// WatchAcks starts watching for subs to ack the n messages with ids from baseID. It must be called before the messages are delivered so that no ack is missed.
+func WatchAcks(baseID uint64, n int, subs []*Subscription) *AckWatch {
+	watch := &AckWatch{
+		ids:     make([]uint64, n),
+		pending: make(map[*Subscription]map[uint64]bool, len(subs)),
+		missed:  make(map[*Subscription]bool),
+		changed: make(chan struct{}, 1),
+	}
+	for i := range watch.ids {
+		watch.ids[i] = baseID + uint64(i)
+	}
+	for _, sub := range subs {
+		ids := make(map[uint64]bool, n)
+		for _, id := range watch.ids {
+			ids[id] = true
+		}
+		watch.pending[sub] = ids
+	}
+	ackWatchesMu.Lock()
+	defer ackWatchesMu.Unlock()
+	for _, id := range watch.ids {
+		ackWatches[id] = watch
+	}
+	return watch
+}
+
+// Undelivered stops waiting on subscription sub for those of the watched messages it does not hold and has not acked, which it was never given because of its size limit or backlog cap. It must be called once delivery has finished.
+func (watch *AckWatch) Undelivered(sub *Subscription) {
+	held := UnAckedStatus(sub, watch.ids)
+	ackWatchesMu.Lock()
+	defer ackWatchesMu.Unlock()
+	for id := range watch.pending[sub] {
+		if !held[id] {
+			delete(watch.pending[sub], id)
+			watch.missed[sub] = true
+		}
+	}
+}
+
+// done reports whether no watched ack is still outstanding. The caller must hold ackWatchesMu.
+func (watch *AckWatch) done() bool {
+	for _, ids := range watch.pending {
+		if len(ids) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Wait blocks until every subscription has acked every watched message or timeout has passed, and reports, per subscription's current name, whether it acked them all.
+func (watch *AckWatch) Wait(timeout time.Duration) map[string]bool {
+	defer watch.Cancel()
+	timer := clock.NewTimer(timeout)
+	defer timer.Stop()
+	expired := timer.C()
+	for timedOut := false; !timedOut; {
+		ackWatchesMu.Lock()
+		finished := watch.done()
+		ackWatchesMu.Unlock()
+		if finished {
+			break
+		}
+		select {
+		case <-watch.changed:
+		case <-expired:
+			timedOut = true
+		}
+	}
+	ackWatchesMu.Lock()
+	defer ackWatchesMu.Unlock()
+	acked := make(map[string]bool, len(watch.pending))
+	for sub, ids := range watch.pending {
+		acked[sub.Name()] = len(ids) == 0 && !watch.missed[sub]
+	}
+	return acked
+}
+
+// Cancel stops watching for acks.
+func (watch *AckWatch) Cancel() {
+	ackWatchesMu.Lock()
+	defer ackWatchesMu.Unlock()
+	for _, id := range watch.ids {
+		if ackWatches[id] == watch {
+			delete(ackWatches, id)
+		}
+	}
+}
+
+// NotifyAcked tells senders waiting with wait_for_all that sub has acked ids.
+func NotifyAcked(sub *Subscription, ids []uint64) {
+	ackWatchesMu.Lock()
+	defer ackWatchesMu.Unlock()
+	if len(ackWatches) == 0 {
+		return
+	}
+	for _, id := range ids {
+		watch, ok := ackWatches[id]
+		if !ok || !watch.pending[sub][id] {
+			continue
+		}
+		delete(watch.pending[sub], id)
+		select {
+		case watch.changed <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// NotifyDropped tells senders waiting with wait_for_all that sub no longer holds ids and will never ack them.
+func NotifyDropped(sub *Subscription, ids []uint64) {
+	ackWatchesMu.Lock()
+	defer ackWatchesMu.Unlock()
+	if len(ackWatches) == 0 {
+		return
+	}
+	for _, id := range ids {
+		watch, ok := ackWatches[id]
+		if !ok || !watch.pending[sub][id] {
+			continue
+		}
+		delete(watch.pending[sub], id)
+		watch.missed[sub] = true
+		select {
+		case watch.changed <- struct{}{}:
+		default:
+		}
+	}
+}
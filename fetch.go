@@ -0,0 +1,86 @@
+package main
+
+import (
+	"flag"
+	"time"
+)
+
+var pullCoalesceWindow = flag.Duration("pull-coalesce-window", 0, "How long the first of concurrent pulls from one subscription waits for others to join it in one read of their messages; 0 reads for each pull at once")
+
+// A fetchWant is what one pull that joined a fetchGroup wants read: ids in order, up to budget bytes as GetMessagesWithin counts them.
+type fetchWant struct {
+	ids    []uint64
+	budget int
+}
+
+// A fetchGroup gathers the reads of pulls from one subscription that arrive within -pull-coalesce-window, so a message wanted by several of them is read once. Its maps are written only by the pull that leads it, before done is closed.
+type fetchGroup struct {
+	wants  []fetchWant // Guarded by the subscription's fetchMu.
+	done   chan struct{}
+	bodies map[uint64]string
+	errs   map[uint64]error
+}
+
+// fetch returns a function reading the bodies of messages for a pull from sub that wants ids, up to budget bytes. With -pull-coalesce-window, the first pull waits out the window, then reads what every pull that joined it meanwhile wants once for all of them.
+func (sub *Subscription) fetch(ids []uint64, budget int) func(id uint64) (string, error) {
+	window := *pullCoalesceWindow
+	if window <= 0 || len(ids) == 0 {
+		return getMessage
+	}
+	sub.fetchMu.Lock()
+	g := sub.fetching
+	leader := g == nil
+	if leader {
+		g = &fetchGroup{done: make(chan struct{})}
+		sub.fetching = g
+	}
+	g.wants = append(g.wants, fetchWant{ids, budget})
+	sub.fetchMu.Unlock()
+
+	if leader {
+		g.read(sub, window)
+	}
+	<-g.done
+	return func(id uint64) (string, error) {
+		if body, ok := g.bodies[id]; ok {
+			return body, nil
+		}
+		if err, ok := g.errs[id]; ok {
+			return "", err
+		}
+		return getMessage(id)
+	}
+}
+
+// read waits out the window, closes the group to further pulls, and reads what each pull wants. Like an uncoalesced pull, each stops at the first message that takes it over its budget, so a pull with a small budget costs no more reads for joining a group.
+func (g *fetchGroup) read(sub *Subscription, window time.Duration) {
+	<-clock.NewTimer(window).C()
+	sub.fetchMu.Lock()
+	sub.fetching = nil
+	sub.fetchMu.Unlock()
+
+	g.bodies = make(map[uint64]string)
+	g.errs = make(map[uint64]error)
+	for _, want := range g.wants {
+		total, taken := 0, 0
+		for _, id := range want.ids {
+			if _, failed := g.errs[id]; failed {
+				continue
+			}
+			body, ok := g.bodies[id]
+			if !ok {
+				var err error
+				if body, err = getMessage(id); err != nil {
+					g.errs[id] = err
+					continue
+				}
+				g.bodies[id] = body
+			}
+			if total += len(body); want.budget > 0 && total > want.budget && taken > 0 {
+				break
+			}
+			taken++
+		}
+	}
+	close(g.done)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// walFailures counts failed WAL writes and snapshots since startup. Accessed atomically.
+var walFailures uint64
+
+// walFailing is 1 while the latest WAL write or snapshot has failed. Accessed atomically.
+var walFailing int32
+
+// walResult records the outcome of a WAL write or snapshot. A failure is counted, and the WAL reported failing until a later write succeeds.
+func walResult(err error) {
+	if err != nil {
+		atomic.AddUint64(&walFailures, 1)
+		atomic.StoreInt32(&walFailing, 1)
+		return
+	}
+	atomic.StoreInt32(&walFailing, 0)
+}
+
+// lastReap is when the reaper last ran, in Unix nanoseconds, or 0 if it has not yet. Accessed atomically.
+var lastReap int64
+
+// Statuses of the WAL as reported by /healthz?verbose=true.
+const (
+	WALDisabled = "disabled"
+	WALOK       = "ok"
+	WALFailing  = "failing"
+)
+
+// HealthDetail is the verbose form of /healthz.
+type HealthDetail struct {
+	Healthy         bool       `json:"healthy"`
+	StorageState    string     `json:"storage_breaker"`
+	StorageWritable bool       `json:"storage_writable"`
+	WAL             string     `json:"wal"`
+	WALFailures     uint64     `json:"wal_failures"`
+	ReaperLastRun   *time.Time `json:"reaper_last_run"`
+	Degraded        int        `json:"degraded"` // How many of the breaker, storage and WAL are not in good order.
+}
+
+// CheckHealth reports the status of each subsystem, probing storage with a throwaway write at most every storageProbeTTL.
+func CheckHealth() HealthDetail {
+	d := HealthDetail{
+		StorageState:    storageBreaker.State(),
+		StorageWritable: storageWritable(),
+		WAL:             WALDisabled,
+		WALFailures:     atomic.LoadUint64(&walFailures),
+	}
+	d.Healthy = d.StorageState != BreakerOpen
+	if *walEnabled {
+		d.WAL = WALOK
+		if atomic.LoadInt32(&walFailing) == 1 {
+			d.WAL = WALFailing
+		}
+	}
+	if ns := atomic.LoadInt64(&lastReap); ns != 0 {
+		t := time.Unix(0, ns)
+		d.ReaperLastRun = &t
+	}
+	if d.StorageState != BreakerClosed {
+		d.Degraded++
+	}
+	if !d.StorageWritable {
+		d.Degraded++
+	}
+	if d.WAL == WALFailing {
+		d.Degraded++
+	}
+	return d
+}
+
+// storageProbeTTL is how long the result of a storage probe is reused, so that frequent verbose health checks do not each touch the disk.
+const storageProbeTTL = 5 * time.Second
+
+var storageProbe struct {
+	sync.Mutex
+	at       time.Time
+	writable bool
+}
+
+// storageWritable reports whether a file can be created in the data directory, as of the last probe.
+func storageWritable() bool {
+	storageProbe.Lock()
+	defer storageProbe.Unlock()
+	now := clock.Now()
+	if storageProbe.at.IsZero() || now.Sub(storageProbe.at) >= storageProbeTTL {
+		storageProbe.writable = probeStorage()
+		storageProbe.at = now
+	}
+	return storageProbe.writable
+}
+
+// probeStorage creates and removes a file in the data directory, reporting whether it could.
+func probeStorage() bool {
+	f, err := ioutil.TempFile(*dataDirname, ".healthz-")
+	if err != nil {
+		return false
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return true
+}
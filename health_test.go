@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWALFailingClearsOnSuccess(t *testing.T) {
+	withWAL(t)
+	t.Cleanup(func() { walResult(nil) })
+	walResult(errors.New("disk full"))
+	if got := CheckHealth().WAL; got != WALFailing {
+		t.Errorf("after a failed write the WAL is %q, want %q", got, WALFailing)
+	}
+	walResult(nil)
+	if got := CheckHealth().WAL; got != WALOK {
+		t.Errorf("after a successful write the WAL is %q, want %q", got, WALOK)
+	}
+}
+
+func TestStorageProbeCached(t *testing.T) {
+	setUp(t)
+	fake := useFakeClock(t)
+	storageProbe.at = time.Time{}
+	if !storageWritable() {
+		t.Fatal("empty data directory not writable")
+	}
+	*dataDirname = filepath.Join(*dataDirname, "missing")
+	if !storageWritable() {
+		t.Error("storage probed again within its TTL")
+	}
+	fake.Advance(storageProbeTTL)
+	if storageWritable() {
+		t.Error("probe result reused past its TTL")
+	}
+}
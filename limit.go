@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+var maxConcurrent = flag.Int("max-concurrent", 0, "Maximum requests handled at once; more are refused with 503. Requests blocked waiting, such as a /send with wait_for_delivery or an idle /tail or /logs stream, give up their slot while they wait. 0 means no limit")
+
+// inFlight counts requests currently being handled, for /stats. Accessed atomically.
+var inFlight int64
+
+// inFlightByPath counts requests currently being handled per URL path, so shutdown can say what it is waiting for.
+var inFlightByPath = make(map[string]int)
+var inFlightByPathMu sync.Mutex
+
+// InFlightPaths returns how many requests are being handled for each path that has any.
+func InFlightPaths() map[string]int {
+	inFlightByPathMu.Lock()
+	defer inFlightByPathMu.Unlock()
+	paths := make(map[string]int, len(inFlightByPath))
+	for path, n := range inFlightByPath {
+		paths[path] = n
+	}
+	return paths
+}
+
+func trackPath(path string, delta int) {
+	inFlightByPathMu.Lock()
+	defer inFlightByPathMu.Unlock()
+	if inFlightByPath[path] += delta; inFlightByPath[path] == 0 {
+		delete(inFlightByPath, path)
+	}
+}
+
+type slotKey struct{}
+
+// A slot is a request's place under -max-concurrent. It is only touched by the goroutine handling the request.
+type slot struct {
+	slots chan struct{}
+	held  bool
+}
+
+// idle runs wait, which blocks until some other request makes progress, without holding r's concurrency slot, and takes the slot back once wait returns, unless the client has gone. Waiting requests, such as long polls and idle streams, therefore cannot fill every slot and shed the requests they wait for.
+func idle(r *http.Request, wait func()) {
+	s, _ := r.Context().Value(slotKey{}).(*slot)
+	if s == nil || !s.held {
+		wait()
+		return
+	}
+	<-s.slots
+	s.held = false
+	wait()
+	select {
+	case s.slots <- struct{}{}:
+		s.held = true
+	case <-r.Context().Done():
+	}
+}
+
+// LimitConcurrency wraps h so that at most limit requests are handled at once; any more are refused with 503 instead of queuing. A limit of 0 or less only counts requests.
+func LimitConcurrency(limit int, h http.Handler) http.Handler {
+	slots := make(chan struct{}, limit)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if limit > 0 {
+			select {
+			case slots <- struct{}{}:
+				s := &slot{slots, true}
+				defer func() {
+					if s.held {
+						<-slots
+					}
+				}()
+				r = r.WithContext(context.WithValue(r.Context(), slotKey{}, s))
+			default:
+				writeError(w, http.StatusServiceUnavailable, ErrUnavailable, "server is at its concurrent request limit")
+				return
+			}
+		}
+		atomic.AddInt64(&inFlight, 1)
+		defer atomic.AddInt64(&inFlight, -1)
+		trackPath(r.URL.Path, 1)
+		defer trackPath(r.URL.Path, -1)
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// logStreamBuffer is how many lines a slow /logs client may fall behind before lines are dropped for it.
+const logStreamBuffer = 256
+
+// A LogHub is an io.Writer, installed as a log output, that copies each log line to every connected /logs client.
+type LogHub struct {
+	sync.Mutex
+	clients map[chan string]bool
+}
+
+// Write implements io.Writer. The log package calls it once per line.
+func (h *LogHub) Write(p []byte) (int, error) {
+	line := strings.TrimRight(string(p), "\n")
+	h.Lock()
+	defer h.Unlock()
+	for c := range h.clients {
+		select {
+		case c <- line:
+		default: // Drop the line rather than block logging on a slow client.
+		}
+	}
+	return len(p), nil
+}
+
+func (h *LogHub) subscribe() chan string {
+	c := make(chan string, logStreamBuffer)
+	h.Lock()
+	defer h.Unlock()
+	h.clients[c] = true
+	return c
+}
+
+func (h *LogHub) unsubscribe(c chan string) {
+	h.Lock()
+	defer h.Unlock()
+	delete(h.clients, c)
+}
+
+var logHub = &LogHub{clients: make(map[chan string]bool)}
+
+// ServeLogs streams log lines to the client as server-sent events until it disconnects.
+func ServeLogs(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, ErrInternal, "streaming is not supported on this connection")
+		return
+	}
+	lines := logHub.subscribe()
+	defer logHub.unsubscribe(lines)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		var line string
+		idle(r, func() {
+			select {
+			case <-r.Context().Done():
+			case line = <-lines:
+			}
+		})
+		if r.Context().Err() != nil {
+			return
+		}
+		fmt.Fprintf(w, "data: %s\n\n", line)
+		flusher.Flush()
+	}
+}
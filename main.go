@@ -2,18 +2,36 @@
 package main
 
 import (
+	"archive/tar"
+	"bufio"
+	"bytes"
 	"container/heap"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"io/ioutil"
 	"log"
+	"math/rand"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 // A MessageQueue keeps track of unacked messages. Using a map set for this would be easier but would require tons of sorting ops.
@@ -51,15 +69,229 @@ type Topic struct {
 	sync.RWMutex
 	Name       string
 	NextMesgID uint64
+	inFlight   map[uint64]int // Batches assigned ids but not yet delivered, as base id to size.
 }
 
 // A Subscription keeps track of received messages that have not yet been acknowledged for a given subscription id.
 type Subscription struct {
 	sync.RWMutex
-	Name    string
-	UnAcked MessageQueue
+	name      atomic.Value // The current name, a string; see Name.
+	seq       uint64       // Unique and fixed for the subscription's life, unlike its name.
+	UnAcked   MessageQueue
+	Paused    bool // While paused, pulls return nothing but messages keep accumulating.
+	Options   SubscriptionOptions
+	Skipped   uint64 // Messages not delivered because of Options.MaxMessageBytes.
+	Dropped   uint64 // Messages discarded because the backlog was at Options.MaxBacklog.
+	Coalesced uint64 // Messages replaced by a newer one because of Options.Coalesce.
+	CreatedAt time.Time
+	Cursor    uint64 // The lowest unacked id or, with nothing unacked, one past the highest id ever acked.
+	passed    uint64 // One past the highest id taken out of the heap since the subscription was loaded or created.
+	wal       *subscriptionWAL
+	transient *TransientRing // Created by the first transient message.
+	limiter   rateLimiter
+	arrived   chan struct{} // Signalled, without blocking, whenever an id is pushed.
+	inbound   int64         // Messages assigned ids for this subscription but not yet delivered to it, accessed atomically.
+	destroyed bool          // Set once the subscription is destroyed; nothing more is pushed to it.
+	fetchMu   sync.Mutex
+	fetching  *fetchGroup // Gathering pulls within -pull-coalesce-window; guarded by fetchMu.
+
+	lastActive   int64 // Unix nanoseconds, accessed atomically.
+	lastPull     int64 // Unix nanoseconds of the last pull, accessed atomically.
+	pullInterval int64 // Moving average of nanoseconds between pulls, accessed atomically.
+}
+
+// SubscriptionOptions are set when a subscription is created with /createsub. The zero value is what implicitly created subscriptions get.
+type SubscriptionOptions struct {
+	MaxMessageBytes int     `json:"max_message_bytes,omitempty"` // Larger messages are skipped; 0 means no limit.
+	HighWatermark   int     `json:"high_watermark,omitempty"`    // Backlog at or above which the webhook fires; 0 means never.
+	LowWatermark    int     `json:"low_watermark,omitempty"`     // Backlog at or below which a high subscription has recovered.
+	MaxBacklog      int     `json:"max_backlog,omitempty"`       // Cap on unacked messages; 0 means no cap.
+	BacklogPolicy   string  `json:"backlog_policy,omitempty"`    // What to drop at the cap: DropNewest (the default) or DropOldest.
+	RateLimit       float64 `json:"rate_limit,omitempty"`        // Messages per second pulls may return; 0 means -default-rate-limit.
+	NotifyURL       string  `json:"notify_url,omitempty"`        // POSTed to when the backlog goes from empty to not.
+	StrictOrder     bool    `json:"strict_order,omitempty"`      // Pulls return only the lowest unacked message.
+	Labels          Labels  `json:"labels,omitempty"`            // Matched against the selector of each send.
+	Coalesce        bool    `json:"coalesce,omitempty"`          // Each message delivered replaces any still unacked.
+}
+
+// Backlog policies for subscriptions with a max_backlog.
+const (
+	DropNewest = "drop_newest"
+	DropOldest = "drop_oldest"
+)
+
+// ParseSubscriptionOptions reads subscription options from the request form.
+func ParseSubscriptionOptions(r *http.Request) (SubscriptionOptions, error) {
+	var opts SubscriptionOptions
+	if s := r.Form.Get("max_message_bytes"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return opts, fmt.Errorf("invalid max_message_bytes %q", s)
+		}
+		opts.MaxMessageBytes = n
+	}
+	for _, o := range []struct {
+		name string
+		dst  *int
+	}{{"high_watermark", &opts.HighWatermark}, {"low_watermark", &opts.LowWatermark}, {"max_backlog", &opts.MaxBacklog}} {
+		s := r.Form.Get(o.name)
+		if s == "" {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return opts, fmt.Errorf("invalid %s %q", o.name, s)
+		}
+		*o.dst = n
+	}
+	if opts.LowWatermark != 0 && opts.LowWatermark >= opts.HighWatermark {
+		return opts, errors.New("low_watermark must be below high_watermark")
+	}
+	if s := r.Form.Get("rate_limit"); s != "" {
+		rate, err := strconv.ParseFloat(s, 64)
+		if err != nil || rate <= 0 {
+			return opts, fmt.Errorf("invalid rate_limit %q", s)
+		}
+		opts.RateLimit = rate
+	}
+	if opts.NotifyURL = r.Form.Get("notify_url"); opts.NotifyURL != "" {
+		if err := checkCallbackURL(opts.NotifyURL); err != nil {
+			return opts, fmt.Errorf("invalid notify_url %q: %v", opts.NotifyURL, err)
+		}
+	}
+	if s := r.Form.Get("strict_order"); s != "" {
+		strict, err := strconv.ParseBool(s)
+		if err != nil {
+			return opts, fmt.Errorf("invalid strict_order %q", s)
+		}
+		opts.StrictOrder = strict
+	}
+	if s := r.Form.Get("coalesce"); s != "" {
+		coalesce, err := strconv.ParseBool(s)
+		if err != nil {
+			return opts, fmt.Errorf("invalid coalesce %q", s)
+		}
+		opts.Coalesce = coalesce
+	}
+	if s := r.Form.Get("labels"); s != "" {
+		labels, err := ParseLabels(s)
+		if err != nil {
+			return opts, err
+		}
+		opts.Labels = labels
+	}
+	switch opts.BacklogPolicy = r.Form.Get("backlog_policy"); opts.BacklogPolicy {
+	case "", DropNewest, DropOldest:
+	default:
+		return opts, fmt.Errorf("backlog_policy must be %s or %s", DropNewest, DropOldest)
+	}
+	return opts, nil
+}
+
+// bounded reports whether sub's options limit how many messages it holds, which /replay and /transfer do not apply.
+func (sub *Subscription) bounded() bool {
+	return sub.Options.Coalesce || sub.Options.MaxBacklog > 0
+}
+
+// Accepts reports whether a message of the given size should be delivered to sub.
+func (sub *Subscription) Accepts(size int) bool {
+	return sub.Options.MaxMessageBytes == 0 || size <= sub.Options.MaxMessageBytes
+}
+
+// push adds id to the subscription's unacked heap. The caller must hold sub's write lock and call syncWAL after releasing it.
+func (sub *Subscription) push(id uint64) {
+	if sub.destroyed {
+		return
+	}
+	heap.Push(&sub.UnAcked, id)
+	holdReceipt(id)
+	sub.logRecord('+', id)
+	sub.moveCursor()
+	sub.compactWAL()
+	select {
+	case sub.arrived <- struct{}{}:
+	default:
+	}
+}
+
+// moveCursor brings sub.Cursor up to date after the heap has changed. removed are ids just taken out of the heap. The cursor never moves backwards, even when an id below it is pushed again by /replay or /transfer. The caller must hold sub's write lock.
+func (sub *Subscription) moveCursor(removed ...uint64) {
+	for _, id := range removed {
+		if id >= sub.passed {
+			sub.passed = id + 1
+		}
+	}
+	next := sub.passed
+	if len(sub.UnAcked) > 0 {
+		next = sub.UnAcked[0]
+	}
+	if next > sub.Cursor {
+		sub.Cursor = next
+	}
+}
+
+// popOldest removes and returns the lowest id in the unacked heap. The caller must hold sub's write lock and call syncWAL after releasing it, and the heap must not be empty.
+func (sub *Subscription) popOldest() uint64 {
+	id := heap.Pop(&sub.UnAcked).(uint64)
+	sub.logRecord('-', id)
+	sub.moveCursor(id)
+	sub.compactWAL()
+	return id
+}
+
+// removeMatching takes every id for which match returns true out of the unacked heap and returns them. The caller must hold sub's write lock and call syncWAL after releasing it.
+func (sub *Subscription) removeMatching(match func(uint64) bool) []uint64 {
+	// Removing elements one at a time with heap.Remove shuffles the elements we haven't looked at yet, so filter and re-heapify instead.
+	removed := make([]uint64, 0)
+	kept := sub.UnAcked[:0]
+	for _, id := range sub.UnAcked {
+		if match(id) {
+			removed = append(removed, id)
+			sub.logRecord('-', id)
+		} else {
+			kept = append(kept, id)
+		}
+	}
+	sub.UnAcked = kept
+	heap.Init(&sub.UnAcked)
+	sub.moveCursor(removed...)
+	sub.compactWAL()
+	return removed
 }
 
+// Counters holds in-memory operation counts reported by /stats. Fields are updated atomically.
+type Counters struct {
+	MessagesSent  uint64
+	MessagesAcked uint64
+	Pulls         uint64
+	Corrupt       uint64 // Message reads that failed checksum verification.
+	BodyBytes     uint64 // Bytes of message bodies stored.
+	StoredBytes   uint64 // Bytes written to message files for them, after any compression.
+	DiskReads     uint64 // Message files read from storage.
+	SharedReads   uint64 // Message reads satisfied by another pull's read of the same file.
+}
+
+// Reset zeros every counter.
+func (c *Counters) Reset() {
+	atomic.StoreUint64(&c.MessagesSent, 0)
+	atomic.StoreUint64(&c.MessagesAcked, 0)
+	atomic.StoreUint64(&c.Pulls, 0)
+	atomic.StoreUint64(&c.Corrupt, 0)
+	atomic.StoreUint64(&c.BodyBytes, 0)
+	atomic.StoreUint64(&c.StoredBytes, 0)
+	atomic.StoreUint64(&c.DiskReads, 0)
+	atomic.StoreUint64(&c.SharedReads, 0)
+}
+
+// Build information, set at build time with -ldflags "-X main.version=... -X main.commit=... -X main.buildDate=...".
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+var counters = &Counters{}
+
 var subs = make(map[string]*Subscription)
 var subsMu = sync.RWMutex{}
 
@@ -68,219 +300,2729 @@ var topic = &Topic{Name: "<default-topic>"}
 var dataDirname = flag.String("data-dir", ".", "Root directory for data storage")
 var host = flag.String("host", "127.0.0.1", "HTTP host name to bind to")
 var port = flag.Int("port", 8080, "HTTP port to bind to")
+var tlsCert = flag.String("tls-cert", "", "TLS certificate file; serve HTTPS when set")
+var tlsKey = flag.String("tls-key", "", "TLS private key file")
+var validate = flag.String("validate", "", "Reject sent messages that are not \"json\" or do not match \"regex:PATTERN\"")
+var allowMetricsReset = flag.Bool("allow-metrics-reset", false, "Enable the /metrics-reset endpoint (for test harnesses)")
+var clientCA = flag.String("client-ca", "", "CA bundle used to require and verify client certificates (requires TLS)")
+
+var writeRetries = flag.Int("write-retries", 2, "Times to retry a failed message write before failing the send")
+
+// writeRetryDelay is the backoff before the first write retry; it doubles on each later attempt.
+const writeRetryDelay = 10 * time.Millisecond
+
+var unixSocket = flag.String("unix-socket", "", "Listen on this Unix domain socket instead of TCP host and port")
+var shutdownTimeout = flag.Duration("shutdown-timeout", 10*time.Second, "How long shutdown waits for in-flight requests before closing their connections")
+
+var maxSubs = flag.Int("max-subs", 0, "Maximum number of subscriptions; 0 means no limit")
+var streamPullThreshold = flag.Int("stream-pull-threshold", 0, "Pulls returning more than this many messages are written as each body is read rather than built in memory first; 0 never streams. Ignored with -max-pull-bytes")
+var pullErrorMode = flag.String("pull-error-mode", "fail", "What a pull does when a message cannot be read: \"fail\" the whole pull with 500, or \"skip\" it and list it as missing")
+var emptyPullStatus = flag.Int("empty-pull-status", http.StatusOK, "Status of a pull that returns no messages: 200 with an empty list, or 204 with no body")
+var maxPullBytes = flag.Int("max-pull-bytes", 0, "Most bytes of message bodies one pull returns; at least one message is always returned. 0 means no limit")
+var implicitSubs = flag.String("implicit-subs", "on", "Which requests create an unknown subscription: \"on\" (any), \"ack-only\" (pulls do, acks and the rest do not), or \"off\" (none; use /createsub)")
+var subEviction = flag.String("sub-eviction", "reject", "What to do when -max-subs is reached: \"reject\" new subscriptions or evict the least recently active (\"lru\")")
+
+var fanoutWorkers = flag.Int("fanout-workers", 4, "Goroutines used to deliver each sent batch to subscriptions")
+var asyncFanoutThreshold = flag.Int("async-fanout-threshold", 0, "With more subscriptions than this, /send returns before delivery finishes; 0 always waits")
 
 var validSubRegexp = regexp.MustCompile(`^([a-zA-Z])([a-zA-Z0-9_-])*$`)
 
-// GetSubscription gets a sub by name and creates a new one if it doesn't exist.
-func GetSubscription(w http.ResponseWriter, r *http.Request) (*Subscription, bool) {
-	name := r.Form.Get("sub")
+// messageValidator is set from the -validate flag; nil accepts every message.
+var messageValidator func(string) bool
+
+// NewMessageValidator returns a validator for a -validate mode, or nil if mode is empty.
+func NewMessageValidator(mode string) (func(string) bool, error) {
+	switch {
+	case mode == "":
+		return nil, nil
+	case mode == "json":
+		return func(m string) bool { return json.Valid([]byte(m)) }, nil
+	case strings.HasPrefix(mode, "regex:"):
+		re, err := regexp.Compile(strings.TrimPrefix(mode, "regex:"))
+		if err != nil {
+			return nil, err
+		}
+		return re.MatchString, nil
+	}
+	return nil, fmt.Errorf("unknown validation mode %q", mode)
+}
+
+// FindInvalidMessage returns the index of the first message rejected by the configured validator, or -1 if all are acceptable.
+func FindInvalidMessage(messages []string) int {
+	if messageValidator == nil {
+		return -1
+	}
+	for i, m := range messages {
+		if !messageValidator(m) {
+			return i
+		}
+	}
+	return -1
+}
+
+// DedupBatch collapses identical messages in a batch. It returns the distinct messages in order of first appearance, their metas (nil if metas is nil), and for each input message the index of its distinct message.
+func DedupBatch(messages []string, metas []MessageMeta) ([]string, []MessageMeta, []int) {
+	unique := make([]string, 0, len(messages))
+	var uniqueMetas []MessageMeta
+	positions := make([]int, len(messages))
+	first := make(map[string]int, len(messages))
+	for i, m := range messages {
+		j, ok := first[m]
+		if !ok {
+			j = len(unique)
+			first[m] = j
+			unique = append(unique, m)
+			if metas != nil {
+				uniqueMetas = append(uniqueMetas, metas[i])
+			}
+		}
+		positions[i] = j
+	}
+	return unique, uniqueMetas, positions
+}
+
+// implicitCreate reports whether -implicit-subs lets a request create the subscription it names. pull is true for /pull.
+func implicitCreate(pull bool) bool {
+	return *implicitSubs == "on" || pull && *implicitSubs == "ack-only"
+}
+
+// GetSubscription gets a sub by name and, if create is true, creates a new one if it doesn't exist.
+func GetSubscription(w http.ResponseWriter, r *http.Request, create bool) (*Subscription, bool) {
+	return GetSubscriptionNamed(w, r.Form.Get("sub"), create)
+}
+
+// GetSubscriptionNamed is GetSubscription for a name given other than as the sub parameter.
+func GetSubscriptionNamed(w http.ResponseWriter, name string, create bool) (*Subscription, bool) {
 	if !validSubRegexp.MatchString(name) {
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, ErrInvalidSub, fmt.Sprintf("invalid subscription name %q", name))
 		return nil, false
 	}
-	subsMu.Lock() // Yes, we want the exclusive write lock
-	defer subsMu.Unlock()
-	sub, ok := subs[name]
-	if ok {
+	if !create {
+		sub, ok := LookupSubscription(name)
+		if !ok {
+			writeError(w, http.StatusNotFound, ErrNotFound, fmt.Sprintf("no subscription %q", name))
+			return nil, false
+		}
+		sub.touch()
 		return sub, true
 	}
+	sub, created, err := createSubscription(name, SubscriptionOptions{})
+	if err == errSubLimit {
+		writeError(w, http.StatusTooManyRequests, ErrSubLimit, fmt.Sprintf("subscription limit of %d reached", *maxSubs))
+		return nil, false
+	}
+	if !created {
+		sub.touch()
+	}
+	return sub, true
+}
 
-	sub = &Subscription{
-		Name:    name,
-		UnAcked: make(MessageQueue, 0),
+func newSubscription(name string, opts SubscriptionOptions) *Subscription {
+	sub := &Subscription{
+		seq:       atomic.AddUint64(&subSeq, 1),
+		UnAcked:   make(MessageQueue, 0),
+		Options:   opts,
+		CreatedAt: clock.Now(),
+		arrived:   make(chan struct{}, 1),
 	}
+	sub.name.Store(name)
 	heap.Init(&sub.UnAcked)
-	subs[name] = sub
-	return sub, true
+	sub.touch()
+	return sub
 }
 
-// DestroySubscription will ensure that state is no longer accumulated for the given sub.
-func DestroySubscription(sub *Subscription) {
-	subsMu.Lock()
-	defer subsMu.Unlock()
-	delete(subs, sub.Name)
+// subSeq is the seq of the most recently made Subscription. Accessed atomically.
+var subSeq uint64
+
+// Name returns the subscription's current name. It may be called without holding sub's lock, but /rename can change the name at any moment, so code that must see a consistent name should read it once.
+func (sub *Subscription) Name() string {
+	return sub.name.Load().(string)
 }
 
-// CreateMessageIds will increment the topic's next message id by nMessage and add the added ids to the unacknowledged message list for that topic.
-func CreateMessageIds(nMessage int) uint64 {
-	topic.Lock()
-	defer topic.Unlock()
-	baseID := topic.NextMesgID
-	topic.NextMesgID += uint64(nMessage)
-	return baseID
+// touch records activity on the subscription for least-recently-used eviction.
+func (sub *Subscription) touch() {
+	atomic.StoreInt64(&sub.lastActive, clock.Now().UnixNano())
 }
 
-// FindUnAckedMessageIds returns up to maxMessages message ids by examining the the unacked messages priority queue of associated with subscription.
-func FindUnAckedMessageIds(sub *Subscription, maxMessages int) []uint64 {
-	sub.RLock()
-	defer sub.RUnlock()
-	n := maxMessages
-	if len(sub.UnAcked) < maxMessages {
-		n = len(sub.UnAcked)
-	}
-	messages := make([]uint64, n)
-	copy(messages, sub.UnAcked[0:n])
-	return messages
+// LastActive returns when the subscription was last created, pulled, acked, or otherwise looked up by name.
+func (sub *Subscription) LastActive() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&sub.lastActive))
 }
 
-// PutMessages stores messages permanently and assigns them (previously created) message ids beginning at baseID.
-func PutMessages(messages []string, baseID uint64) error {
-	for i, m := range messages {
-		filename := filepath.Join(*dataDirname, fmt.Sprint(baseID+uint64(i)))
-		if err := ioutil.WriteFile(filename, []byte(m), 0644); err != nil {
-			log.Printf("In PutMessages: %v", err)
-			return err
+// A nameClaim marks a subscription name as busy: being created, renamed to or from, or having its files removed. Requests for a claimed name wait for the claim to be released rather than act on the name at the same time, so exactly one Subscription is ever made for a name and no two of them share its files.
+type nameClaim struct {
+	done   chan struct{}
+	create bool          // The claim is for a subscription being created, which counts towards -max-subs.
+	sub    *Subscription // Set by a successful creation.
+	err    error         // Set by a failed creation.
+}
+
+// claims holds the claimed subscription names. It is guarded by subsMu.
+var claims = make(map[string]*nameClaim)
+
+// claimName claims name, which must not already be claimed. The caller must hold subsMu's write lock.
+func claimName(name string, create bool) *nameClaim {
+	c := &nameClaim{done: make(chan struct{}), create: create}
+	claims[name] = c
+	return c
+}
+
+// releaseName releases the claim c on name and wakes anyone waiting on it. The caller must hold subsMu's write lock.
+func releaseName(name string, c *nameClaim) {
+	delete(claims, name)
+	close(c.done)
+}
+
+// waitForNames returns once none of names is claimed. The caller must hold subsMu's write lock, which is released while waiting and held again on return.
+func waitForNames(names ...string) {
+	for {
+		var c *nameClaim
+		for _, name := range names {
+			if c = claims[name]; c != nil {
+				break
+			}
 		}
-	}
-	for _, sub := range subs {
-		sub.Lock()
-		for i := baseID; i < baseID+uint64(len(messages)); i++ {
-			heap.Push(&sub.UnAcked, i)
+		if c == nil {
+			return
 		}
-		sub.Unlock()
+		subsMu.Unlock()
+		<-c.done
+		subsMu.Lock()
 	}
-	return nil
 }
 
-// GetMessages returns a map of the topic message bodies associated with ids.
-func GetMessages(ids []uint64) (map[uint64]string, error) {
-	messages := make(map[uint64]string)
-	for _, id := range ids {
-		filename := filepath.Join(*dataDirname, fmt.Sprint(id))
-		bs, err := ioutil.ReadFile(filename)
-		if err != nil {
-			log.Printf("In GetMessages: %v", err)
-			return messages, err
+// createSubscription returns the subscription called name, creating it with opts if it does not exist. created reports whether this call created it. Its snapshot is written without holding subsMu, while concurrent calls for the same name wait. It fails with errSubLimit if -max-subs forbids another.
+func createSubscription(name string, opts SubscriptionOptions) (sub *Subscription, created bool, err error) {
+	subsMu.Lock()
+	for {
+		c, ok := claims[name]
+		if !ok {
+			if sub, ok := subs[name]; ok {
+				subsMu.Unlock()
+				return sub, false, nil
+			}
+			break
 		}
-		messages[id] = string(bs)
+		subsMu.Unlock()
+		<-c.done
+		if c.create && c.err != nil {
+			return nil, false, c.err
+		}
+		subsMu.Lock()
 	}
-	return messages, nil
-}
+	c := claimName(name, true)
+	victim, ok := makeRoom(name)
+	if !ok {
+		c.err = errSubLimit
+	} else {
+		c.sub = newSubscription(name, opts)
+	}
+	subsMu.Unlock()
 
-// AckMessages removes ids from the topic priority queue of unacked messages.
-func AckMessages(ids []uint64, sub *Subscription) {
-	idMap := make(map[uint64]bool)
-	for _, k := range ids {
-		idMap[k] = true
+	if victim != nil {
+		destroyFiles(victim)
 	}
-	nID := 0
-	for range ids {
-		nID++
+	if c.sub != nil {
+		c.sub.persist()
 	}
 
-	sub.Lock()
-	defer sub.Unlock()
-	// We go back to front so we don't disturb lower indicies.
-	for i := len(sub.UnAcked) - 1; i >= 0; i-- {
-		if nID == 0 {
-			// User wanted to ack nID (unique) ids, we're done if we've accounted for them all.
-			return
+	subsMu.Lock()
+	if c.sub != nil {
+		subs[name] = c.sub
+	}
+	releaseName(name, c)
+	subsMu.Unlock()
+	return c.sub, c.err == nil, c.err
+}
+
+// makeRoom enforces -max-subs before subscription name is created, by refusing it or by evicting the least recently active subscription, per -sub-eviction. Subscriptions still being created count towards the limit. An evicted subscription is returned with its name claimed, for the caller to pass to destroyFiles once subsMu is released. The caller must hold subsMu's write lock.
+func makeRoom(name string) (victim *Subscription, ok bool) {
+	if *maxSubs <= 0 {
+		return nil, true
+	}
+	n := len(subs) - 1
+	for _, c := range claims {
+		if c.create {
+			n++
+		}
+	}
+	if n < *maxSubs {
+		return nil, true
+	}
+	if *subEviction != "lru" {
+		return nil, false
+	}
+	for name, s := range subs {
+		if claims[name] != nil {
+			continue // Being renamed.
 		}
-		if idMap[sub.UnAcked[i]] {
-			heap.Remove(&sub.UnAcked, i)
-			nID--
+		if victim == nil || s.LastActive().Before(victim.LastActive()) {
+			victim = s
 		}
 	}
+	if victim == nil {
+		return nil, false
+	}
+	log.Printf("Evicting least recently active subscription %s to make room for %s", victim.Name(), name)
+	delete(subs, victim.Name())
+	claimName(victim.Name(), false)
+	return victim, true
 }
 
-// JSONResponse  is a type that gives shape to our HTTP response JSON.
-type JSONResponse struct {
-	NMessage int               `json:"n_messages"`
-	Messages map[uint64]string `json:"messages"`
+// destroyFiles stops anything more being pushed to a subscription already removed from subs, releases its backlog, and deletes its snapshot and WAL, then releases the claim on its name taken when it was removed.
+func destroyFiles(sub *Subscription) {
+	sub.Lock()
+	sub.destroyed = true
+	released(sub, sub.UnAcked)
+	sub.Unlock()
+	sub.unpersist()
+	subsMu.Lock()
+	defer subsMu.Unlock()
+	name := sub.Name()
+	releaseName(name, claims[name])
 }
 
-func marshall(messages map[uint64]string) ([]byte, error) {
-	return json.Marshal(JSONResponse{len(messages), messages})
+// Errors returned by CreateSubscription.
+var (
+	errSubExists = errors.New("subscription already exists")
+	errSubLimit  = errors.New("subscription limit reached")
+	errNoSub     = errors.New("no such subscription")
+	errBounded   = errors.New("messages cannot be put back on a coalesce or max_backlog subscription")
+)
+
+// CreateSubscription creates a sub with the given options. It fails with errSubExists if a sub by that name already exists, or errSubLimit if -max-subs forbids another.
+func CreateSubscription(name string, opts SubscriptionOptions) (*Subscription, error) {
+	sub, created, err := createSubscription(name, opts)
+	if err != nil {
+		return nil, err
+	}
+	if !created {
+		return nil, errSubExists
+	}
+	return sub, nil
 }
 
-func main() {
-	flag.Parse()
-	if err := os.MkdirAll(*dataDirname, 0755); err != nil {
-		log.Fatalf("While creating data directory: %v", err)
+// LookupSubscription gets an existing sub by name without creating it. A subscription being renamed is found under neither name.
+func LookupSubscription(name string) (*Subscription, bool) {
+	subsMu.RLock()
+	defer subsMu.RUnlock()
+	if claims[name] != nil {
+		return nil, false
 	}
+	sub, ok := subs[name]
+	return sub, ok
+}
 
-	http.HandleFunc("/send", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			w.WriteHeader(http.StatusMethodNotAllowed)
-			return
-		}
-		r.ParseForm()
-		messages := r.Form["message"]
-		baseID := CreateMessageIds(len(messages))
-		if err := PutMessages(messages, baseID); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+// DestroySubscription will ensure that state is no longer accumulated for the given sub.
+func DestroySubscription(sub *Subscription) {
+	subsMu.Lock()
+	waitForNames(sub.Name())
+	if subs[sub.Name()] != sub {
+		subsMu.Unlock()
+		return
+	}
+	delete(subs, sub.Name())
+	claimName(sub.Name(), false)
+	subsMu.Unlock()
+	destroyFiles(sub)
+}
+
+// DestroySubscriptionsMatching destroys every subscription whose name satisfies match and returns their names, sorted.
+func DestroySubscriptionsMatching(match func(string) bool) []string {
+	subsMu.Lock()
+	destroyed := make([]string, 0)
+	victims := make([]*Subscription, 0)
+	for name, sub := range subs {
+		if match(name) && claims[name] == nil {
+			delete(subs, name)
+			claimName(name, false)
+			destroyed = append(destroyed, name)
+			victims = append(victims, sub)
 		}
-		w.WriteHeader(http.StatusOK)
-	})
+	}
+	subsMu.Unlock()
+	for _, sub := range victims {
+		destroyFiles(sub)
+	}
+	sort.Strings(destroyed)
+	return destroyed
+}
 
-	http.HandleFunc("/unsub", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			w.WriteHeader(http.StatusMethodNotAllowed)
-			return
+// RenameSubscription gives subscription from the name to, keeping its backlog, options and cursor. It fails with errNoSub if from does not exist or errSubExists if to does, including when to is still being created. Pulls and acks already holding the subscription carry on unaffected.
+func RenameSubscription(from, to string) error {
+	subsMu.Lock()
+	waitForNames(from, to)
+	sub, ok := subs[from]
+	if !ok {
+		subsMu.Unlock()
+		return errNoSub
+	}
+	if _, ok := subs[to]; ok {
+		subsMu.Unlock()
+		return errSubExists
+	}
+	// While its files move, both names are claimed, so requests naming either wait, but the subscription stays in subs under from so that sends and scans of every subscription still count it.
+	fromClaim, toClaim := claimName(from, false), claimName(to, false)
+	subsMu.Unlock()
+
+	err := sub.rename(from, to)
+
+	subsMu.Lock()
+	defer subsMu.Unlock()
+	delete(subs, from)
+	subs[sub.Name()] = sub
+	releaseName(from, fromClaim)
+	releaseName(to, toClaim)
+	return err
+}
+
+// BackedUp returns the first of targets holding more than max unacked messages, counting messages already assigned ids but still being delivered to it, or nil if none does. A nil targets means every subscription.
+func BackedUp(targets []*Subscription, max int) *Subscription {
+	if targets == nil {
+		subsMu.RLock()
+		targets = make([]*Subscription, 0, len(subs))
+		for _, sub := range subs {
+			targets = append(targets, sub)
 		}
-		r.ParseForm()
-		sub, ok := GetSubscription(w, r)
-		if !ok {
-			return
+		subsMu.RUnlock()
+	}
+	for _, sub := range targets {
+		if sub.Stats().Backlog+int(atomic.LoadInt64(&sub.inbound)) > max {
+			return sub
 		}
-		DestroySubscription(sub)
-		w.WriteHeader(http.StatusOK)
-	})
+	}
+	return nil
+}
 
-	http.HandleFunc("/pull", func(w http.ResponseWriter, r *http.Request) {
-		r.ParseForm()
-		sub, ok := GetSubscription(w, r)
-		if !ok {
-			return
-		}
-		nMessageString := r.Form.Get("n")
-		nMessage, err := strconv.Atoi(nMessageString)
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			return
+// A Routing says which subscriptions a sent batch is for.
+type Routing struct {
+	Targets       []*Subscription // The batch's recipients before Selector is applied; nil means every subscription.
+	Selector      Labels          // Labels a recipient must carry; nil selects every target.
+	RejectBacklog int             // If 0 or more, refuse the batch when a Watched subscription holds more than this many unacked messages.
+	Watched       []*Subscription // The subscriptions RejectBacklog applies to; nil means the recipients.
+}
+
+// CreateMessageIds will increment the topic's next message id by nMessage and return the first of the ids set aside. It also returns the batch's recipients: those of routing's targets, or if targets is nil of every subscription that exists at the moment the ids are assigned, that its selector picks. A subscription created concurrently is therefore either a recipient of the whole batch or of none of it. If routing.RejectBacklog is 0 or more and a watched subscription is over it, no ids are assigned and that subscription is returned as backedUp. Checking under the topic lock, and counting batches still being delivered, keeps concurrent sends from all passing the check and overshooting the limit together. The batch is in flight, and counted in its recipients' inbound counts, until releaseBatch or delivery takes it off again.
+func CreateMessageIds(nMessage int, routing Routing) (baseID uint64, recipients []*Subscription, backedUp *Subscription) {
+	topic.Lock()
+	defer topic.Unlock()
+	recipients = routing.Targets
+	if recipients == nil {
+		// Lock order is topic then subsMu, as in GetStats.
+		subsMu.RLock()
+		recipients = make([]*Subscription, 0, len(subs))
+		for _, sub := range subs {
+			recipients = append(recipients, sub)
 		}
-		messageIDs := FindUnAckedMessageIds(sub, nMessage)
-		messages, err := GetMessages(messageIDs)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+		subsMu.RUnlock()
+	}
+	if routing.Selector != nil {
+		recipients = SelectSubscriptions(recipients, routing.Selector)
+	}
+	if routing.RejectBacklog >= 0 {
+		watched := routing.Watched
+		if watched == nil {
+			watched = recipients
 		}
-		bs, err := marshall(messages)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+		if backedUp = BackedUp(watched, routing.RejectBacklog); backedUp != nil {
+			return 0, nil, backedUp
 		}
-		w.WriteHeader(http.StatusOK)
-		w.Write(bs)
-		w.Write([]byte("\n"))
-	})
+	}
+	for _, sub := range recipients {
+		atomic.AddInt64(&sub.inbound, int64(nMessage))
+	}
+	baseID = topic.NextMesgID
+	topic.NextMesgID += uint64(nMessage)
+	if topic.inFlight == nil {
+		topic.inFlight = make(map[uint64]int)
+	}
+	topic.inFlight[baseID] = nMessage
+	return baseID, recipients, nil
+}
 
-	http.HandleFunc("/ack", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			w.WriteHeader(http.StatusMethodNotAllowed)
-			return
-		}
-		r.ParseForm()
-		sub, ok := GetSubscription(w, r)
-		if !ok {
-			return
+// releaseBatch takes a batch of n messages at baseID that will not be delivered after all off the inbound counts of its recipients and off the batches in flight.
+func releaseBatch(baseID uint64, recipients []*Subscription, n int) {
+	for _, sub := range recipients {
+		atomic.AddInt64(&sub.inbound, -int64(n))
+	}
+	finishBatch(baseID)
+}
+
+// finishBatch records that the batch at baseID is no longer in flight.
+func finishBatch(baseID uint64) {
+	topic.Lock()
+	defer topic.Unlock()
+	delete(topic.inFlight, baseID)
+}
+
+// DeliveredBelow returns an id below which every batch assigned ids so far has finished delivery: the base of the oldest batch in flight, or the next id to be assigned.
+func DeliveredBelow() uint64 {
+	topic.RLock()
+	defer topic.RUnlock()
+	horizon := topic.NextMesgID
+	for base := range topic.inFlight {
+		if base < horizon {
+			horizon = base
 		}
+	}
+	return horizon
+}
 
-		messageIDs := make([]uint64, 0, 16)
-		for _, idString := range r.Form["id"] {
-			id, err := strconv.ParseUint(idString, 10, 64)
-			if err != nil {
-				w.WriteHeader(http.StatusBadRequest)
-				return
+// InFlight returns a test for whether an id belongs to a batch that was in flight when InFlight was called. Subscriptions may not yet hold such ids even though their files exist.
+func InFlight() func(id uint64) bool {
+	topic.RLock()
+	batches := make(map[uint64]int, len(topic.inFlight))
+	for base, n := range topic.inFlight {
+		batches[base] = n
+	}
+	topic.RUnlock()
+	return func(id uint64) bool {
+		for base, n := range batches {
+			if id >= base && id < base+uint64(n) {
+				return true
 			}
-			messageIDs = append(messageIDs, uint64(id))
 		}
-		AckMessages(messageIDs, sub)
-	})
-
+		return false
+	}
+}
+
+// FindUnAckedMessageIds returns the (up to) maxMessages smallest message ids, in ascending order, by examining the unacked messages priority queue associated with subscription.
+func FindUnAckedMessageIds(sub *Subscription, maxMessages int) []uint64 {
+	return findUnAcked(sub, maxMessages, nil)
+}
+
+// FindSelectedMessageIds is like FindUnAckedMessageIds but only considers the given ids, ignoring the rest of the backlog.
+func FindSelectedMessageIds(sub *Subscription, ids []uint64, maxMessages int) []uint64 {
+	selected := make(map[uint64]bool, len(ids))
+	for _, id := range ids {
+		selected[id] = true
+	}
+	return findUnAcked(sub, maxMessages, func(id uint64) bool { return selected[id] })
+}
+
+func findUnAcked(sub *Subscription, maxMessages int, match func(uint64) bool) []uint64 {
+	sub.RLock()
+	defer sub.RUnlock()
+	if sub.Paused {
+		return []uint64{}
+	}
+	n := maxMessages
+	if len(sub.UnAcked) < maxMessages {
+		n = len(sub.UnAcked)
+	}
+	// Only the first element of the heap is guaranteed to be the smallest, so pop from a copy.
+	q := make(MessageQueue, 0, len(sub.UnAcked))
+	for _, id := range sub.UnAcked {
+		if match == nil || match(id) {
+			q = append(q, id)
+		}
+	}
+	heap.Init(&q)
+	now := clock.Now()
+	messages := make([]uint64, 0, n)
+	for len(messages) < n && len(q) > 0 {
+		// Expired messages stay in the heap until the reaper gets to them, but are never delivered.
+		if id := heap.Pop(&q).(uint64); !IsExpired(id, now) {
+			messages = append(messages, id)
+		}
+	}
+	return messages
+}
+
+// messagePath returns the name of the file holding message id.
+func messagePath(id uint64) string {
+	return filepath.Join(*dataDirname, fmt.Sprint(id))
+}
+
+// storedMessage describes a message file found in the data directory.
+type storedMessage struct {
+	ID          uint64
+	Size        int64
+	PublishedAt time.Time
+}
+
+// listStoredMessages returns every message currently in storage, in ascending id order.
+func listStoredMessages() ([]storedMessage, error) {
+	fis, err := ioutil.ReadDir(*dataDirname)
+	if err != nil {
+		return nil, err
+	}
+	stored := make([]storedMessage, 0, len(fis))
+	for _, fi := range fis {
+		id, err := strconv.ParseUint(fi.Name(), 10, 64)
+		if err != nil || fi.IsDir() {
+			continue
+		}
+		stored = append(stored, storedMessage{id, fi.Size(), fi.ModTime()})
+	}
+	sort.Slice(stored, func(i, j int) bool { return stored[i].ID < stored[j].ID })
+	return stored, nil
+}
+
+// writeFileWithRetry writes a message file, retrying up to -write-retries times with jittered exponential backoff.
+func writeFileWithRetry(filename string, data []byte) error {
+	delay := writeRetryDelay
+	for attempt := 0; ; attempt++ {
+		err := ioutil.WriteFile(filename, data, 0644)
+		if err == nil || attempt >= *writeRetries {
+			return err
+		}
+		log.Printf("Retrying write of %s: %v", filename, err)
+		time.Sleep(delay/2 + time.Duration(rand.Int63n(int64(delay))))
+		delay *= 2
+	}
+}
+
+// removeMessageFiles deletes the first n message files, and any metadata files, of a batch starting at baseID. Each message file goes before its metadata, so a crash part way never leaves a compressed body without the metadata saying how to read it.
+func removeMessageFiles(baseID uint64, n int) {
+	for i := 0; i < n; i++ {
+		id := baseID + uint64(i)
+		if err := os.Remove(messagePath(id)); err != nil && !os.IsNotExist(err) {
+			log.Printf("While rolling back message %d: %v", id, err)
+		}
+		if err := os.Remove(metaPath(id)); err != nil && !os.IsNotExist(err) {
+			log.Printf("While rolling back metadata of message %d: %v", id, err)
+		}
+		forgetBodyFormat(id)
+	}
+}
+
+// PutMessages stores messages permanently, along with their metadata, and assigns them (previously created) message ids beginning at baseID. metas is either nil or holds one entry per message. The messages are delivered to targets, or to every subscription if targets is nil. Either every message is stored and delivered or, on error, none is: files already written are removed and the batch's ids are left unused.
+func PutMessages(messages []string, metas []MessageMeta, baseID uint64, targets []*Subscription) error {
+	if err := storeMessages(messages, metas, baseID); err != nil {
+		releaseBatch(baseID, targets, len(messages))
+		return err
+	}
+	for i, meta := range metas {
+		if meta.ExpiresAt != nil {
+			setExpiry(baseID+uint64(i), *meta.ExpiresAt)
+		}
+		if meta.ReceiptURL != "" {
+			setReceiptURL(baseID+uint64(i), meta.ReceiptURL, true)
+		}
+	}
+	DeliverMessages(messages, baseID, targets)
+	return nil
+}
+
+// storeMessages writes every message file of a batch, removing the ones already written if any write fails. Each message's metadata is written before its body, so a body is never on disk without the metadata that says how it is encoded.
+func storeMessages(messages []string, metas []MessageMeta, baseID uint64) (err error) {
+	if len(messages) == 0 {
+		// Nothing was attempted, so the breaker learns nothing.
+		return nil
+	}
+	defer func() { storageBreaker.Record(err) }()
+	if err := recordNextID(baseID + uint64(len(messages))); err != nil {
+		log.Printf("In PutMessages: %v", err)
+		return err
+	}
+	var bodyBytes, storedBytes uint64
+	for i, m := range messages {
+		id := baseID + uint64(i)
+		var meta MessageMeta
+		if metas != nil {
+			meta = metas[i]
+		}
+		body := []byte(m)
+		checksum := crc32.ChecksumIEEE(body)
+		meta.CRC32 = &checksum
+		data, encoding, err := encodeBody(body)
+		if encoding != "" {
+			size := int64(len(body))
+			meta.Encoding, meta.Size = encoding, &size
+		}
+		if err == nil {
+			err = writeMessageMeta(id, meta)
+		}
+		if err == nil {
+			err = writeFileWithRetry(messagePath(id), data)
+		}
+		if err != nil {
+			log.Printf("In PutMessages: %v", err)
+			removeMessageFiles(baseID, i+1)
+			return err
+		}
+		bodyBytes += uint64(len(body))
+		storedBytes += uint64(len(data))
+	}
+	atomic.AddUint64(&counters.BodyBytes, bodyBytes)
+	atomic.AddUint64(&counters.StoredBytes, storedBytes)
+	return nil
+}
+
+// DeliverMessages pushes the ids of a stored batch onto the heap of every subscription in targets that accepts them, or of every subscription if targets is nil. It must only be called once the whole batch is on disk. With more than -async-fanout-threshold subscriptions, delivery finishes in the background after DeliverMessages returns.
+func DeliverMessages(messages []string, baseID uint64, targets []*Subscription) {
+	if targets == nil {
+		subsMu.RLock()
+		targets = make([]*Subscription, 0, len(subs))
+		for _, sub := range subs {
+			targets = append(targets, sub)
+		}
+		subsMu.RUnlock()
+	}
+
+	if asyncFanout(len(targets)) {
+		go func() {
+			fanOut(targets, messages, baseID)
+			receiptsDelivered(baseID, len(messages))
+			finishBatch(baseID)
+		}()
+		return
+	}
+	fanOut(targets, messages, baseID)
+	receiptsDelivered(baseID, len(messages))
+	finishBatch(baseID)
+}
+
+// asyncFanout reports whether delivery of a batch to n subscriptions finishes in the background, per -async-fanout-threshold.
+func asyncFanout(n int) bool {
+	return *asyncFanoutThreshold > 0 && n > *asyncFanoutThreshold
+}
+
+// fanOut delivers a batch to targets using up to -fanout-workers goroutines.
+func fanOut(targets []*Subscription, messages []string, baseID uint64) {
+	workers := *fanoutWorkers
+	if workers > len(targets) {
+		workers = len(targets)
+	}
+	if workers <= 1 {
+		for _, sub := range targets {
+			deliverTo(sub, messages, baseID)
+		}
+		return
+	}
+	queue := make(chan *Subscription)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for sub := range queue {
+				deliverTo(sub, messages, baseID)
+			}
+		}()
+	}
+	for _, sub := range targets {
+		queue <- sub
+	}
+	close(queue)
+	wg.Wait()
+}
+
+func deliverTo(sub *Subscription, messages []string, baseID uint64) {
+	defer atomic.AddInt64(&sub.inbound, -int64(len(messages)))
+	defer sub.syncWAL()
+	sub.Lock()
+	defer sub.Unlock()
+	if sub.Options.NotifyURL != "" && len(sub.UnAcked) == 0 {
+		// However many sends follow, notify only once until the backlog is drained again.
+		defer func() {
+			if len(sub.UnAcked) > 0 {
+				notifyBacklog(sub.Options.NotifyURL, BacklogNotification{sub.Name(), len(sub.UnAcked), clock.Now()})
+			}
+		}()
+	}
+	if sub.Options.Coalesce {
+		// Only the newest message the subscription accepts is kept, replacing whatever it held.
+		latest := -1
+		var superseded []uint64
+		for i, m := range messages {
+			if !sub.Accepts(len(m)) {
+				sub.Skipped++
+				continue
+			}
+			if latest >= 0 {
+				superseded = append(superseded, baseID+uint64(latest))
+				holdReceipt(baseID + uint64(latest))
+			}
+			latest = i
+		}
+		if latest >= 0 {
+			superseded = append(superseded, sub.removeMatching(func(uint64) bool { return true })...)
+			sub.Coalesced += uint64(len(superseded))
+			sub.push(baseID + uint64(latest))
+			// A message replaced by a newer one is done with, as if acked.
+			SendReceipts(sub.Name(), superseded, clock.Now())
+			NotifyAcked(sub, superseded)
+			markSuperseded(superseded)
+		}
+		return
+	}
+	for i, m := range messages {
+		if !sub.Accepts(len(m)) {
+			sub.Skipped++
+			continue
+		}
+		if sub.Options.MaxBacklog > 0 && len(sub.UnAcked) >= sub.Options.MaxBacklog {
+			sub.Dropped++
+			if sub.Options.BacklogPolicy != DropOldest {
+				continue
+			}
+			evicted := []uint64{sub.popOldest()}
+			released(sub, evicted)
+			// Evicted like a superseded message, its file goes once no other subscription holds it.
+			markSuperseded(evicted)
+		}
+		sub.push(baseID + uint64(i))
+	}
+}
+
+// GetMessages returns a map of the topic message bodies associated with ids.
+func GetMessages(ids []uint64) (map[uint64]string, error) {
+	messages := make(map[uint64]string)
+	for _, id := range ids {
+		body, err := getMessage(id)
+		if err != nil {
+			log.Printf("In GetMessages: %v", err)
+			return messages, err
+		}
+		messages[id] = body
+	}
+	return messages, nil
+}
+
+// getMessage returns the body of message id from the cache or, failing that, storage.
+func getMessage(id uint64) (string, error) {
+	if body, ok := messageCache.Get(id); ok {
+		return body, nil
+	}
+	return readMessage(id)
+}
+
+// vanished reports whether err, from reading message id for a pull from sub, is only because the message was removed after the pull picked it: it expired, or sub no longer holds it. Such a message is left out of the pull rather than failing it.
+func vanished(sub *Subscription, id uint64, err error) bool {
+	return os.IsNotExist(err) && (IsExpired(id, clock.Now()) || !UnAckedStatus(sub, []uint64{id})[id])
+}
+
+// A messageRead is a read of one message file in progress. Concurrent pulls wanting the same message wait for it rather than reading the file again.
+type messageRead struct {
+	done chan struct{}
+	body string
+	err  error
+}
+
+var readsMu sync.Mutex
+var reads = make(map[uint64]*messageRead)
+
+// readMessage reads and decodes the stored body of message id, adding it to the message cache. Calls for an id that is already being read share that read.
+func readMessage(id uint64) (string, error) {
+	readsMu.Lock()
+	if rd, ok := reads[id]; ok {
+		readsMu.Unlock()
+		<-rd.done
+		atomic.AddUint64(&counters.SharedReads, 1)
+		return rd.body, rd.err
+	}
+	rd := &messageRead{done: make(chan struct{})}
+	reads[id] = rd
+	readsMu.Unlock()
+
+	atomic.AddUint64(&counters.DiskReads, 1)
+	bs, err := ioutil.ReadFile(messagePath(id))
+	if err == nil {
+		var body []byte
+		if body, err = decodeMessage(id, bs); err == nil {
+			rd.body = string(body)
+			messageCache.Add(id, rd.body)
+		}
+	}
+	rd.err = err
+
+	readsMu.Lock()
+	delete(reads, id)
+	readsMu.Unlock()
+	close(rd.done)
+	return rd.body, rd.err
+}
+
+// GetMessagesWithin reads the messages with ids for a pull from sub, in order, until their bodies would exceed budget bytes, and returns them along with the ids actually read. The first message is always read, however large. truncated reports whether any ids were left out. A budget of 0 or less reads them all. A message that vanished since the pull picked it is dropped from read. Reads may be shared with concurrent pulls from sub, per -pull-coalesce-window. With skip, a message that cannot be read is listed in missing and passed over rather than failing the read.
+func GetMessagesWithin(sub *Subscription, ids []uint64, budget int, skip bool) (messages map[uint64]string, read, missing []uint64, truncated bool, err error) {
+	messages = make(map[uint64]string)
+	read = make([]uint64, 0, len(ids))
+	total := 0
+	get := sub.fetch(ids, budget)
+	for _, id := range ids {
+		body, err := get(id)
+		if err != nil {
+			if vanished(sub, id, err) {
+				continue
+			}
+			log.Printf("In GetMessagesWithin: %v", err)
+			if skip {
+				missing = append(missing, id)
+				continue
+			}
+			return messages, read, missing, false, err
+		}
+		if total += len(body); budget > 0 && total > budget && len(read) > 0 {
+			return messages, read, missing, true, nil
+		}
+		messages[id] = body
+		read = append(read, id)
+	}
+	return messages, read, missing, false, nil
+}
+
+// MessageMetadata describes a stored message without its body.
+type MessageMetadata struct {
+	ID          uint64     `json:"id"`
+	Size        int64      `json:"size"`
+	PublishedAt time.Time  `json:"published_at"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+}
+
+// GetMessageMetadata stats the stored messages with the given ids, keeping their order.
+func GetMessageMetadata(ids []uint64) ([]MessageMetadata, error) {
+	return getMessageMetadata(nil, ids)
+}
+
+// GetPulledMetadata is GetMessageMetadata for a pull from sub, leaving out messages that vanished since the pull picked them.
+func GetPulledMetadata(sub *Subscription, ids []uint64) ([]MessageMetadata, error) {
+	return getMessageMetadata(sub, ids)
+}
+
+func getMessageMetadata(sub *Subscription, ids []uint64) ([]MessageMetadata, error) {
+	metadata := make([]MessageMetadata, 0, len(ids))
+	for _, id := range ids {
+		fi, err := os.Stat(messagePath(id))
+		if err != nil {
+			if sub != nil && vanished(sub, id, err) {
+				continue
+			}
+			log.Printf("In GetMessageMetadata: %v", err)
+			return metadata, err
+		}
+		md := MessageMetadata{ID: id, Size: storedBodySize(id, fi.Size()), PublishedAt: fi.ModTime()}
+		if t, ok := Expiry(id); ok {
+			md.ExpiresAt = &t
+		}
+		metadata = append(metadata, md)
+	}
+	return metadata, nil
+}
+
+// FindOrphans returns, in ascending order, up to limit ids of stored messages from id from onwards that no subscription holds unacked. Messages of batches still being delivered are not orphans, however few subscriptions hold them yet. more reports whether further orphans follow.
+func FindOrphans(from uint64, limit int) (orphans []uint64, more bool, err error) {
+	horizon := DeliveredBelow()
+	stored, err := listStoredMessages()
+	if err != nil {
+		return nil, false, err
+	}
+	held := make(map[uint64]bool)
+	subsMu.RLock()
+	for _, sub := range subs {
+		sub.RLock()
+		for _, id := range sub.UnAcked {
+			held[id] = true
+		}
+		sub.RUnlock()
+	}
+	subsMu.RUnlock()
+
+	orphans = make([]uint64, 0)
+	for _, m := range stored {
+		if m.ID >= horizon {
+			break
+		}
+		if m.ID < from || held[m.ID] {
+			continue
+		}
+		if len(orphans) == limit {
+			return orphans, true, nil
+		}
+		orphans = append(orphans, m.ID)
+	}
+	return orphans, false, nil
+}
+
+// HeapDump shows a subscription's unacked heap exactly as stored, next to the same ids in order. It is for debugging only.
+type HeapDump struct {
+	Sub    string   `json:"sub"`
+	Raw    []uint64 `json:"raw"`
+	Sorted []uint64 `json:"sorted"`
+}
+
+// DumpHeap copies sub's unacked heap.
+func DumpHeap(sub *Subscription) HeapDump {
+	sub.RLock()
+	raw := append([]uint64{}, sub.UnAcked...)
+	sub.RUnlock()
+	sorted := append([]uint64{}, raw...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return HeapDump{sub.Name(), raw, sorted}
+}
+
+// defaultAgeBuckets are the upper bounds of the buckets of /age-histogram when none are given.
+var defaultAgeBuckets = []time.Duration{time.Minute, 10 * time.Minute, time.Hour}
+
+// An AgeBucket counts the unacked messages published between Min and Max ago. The last bucket has no Max.
+type AgeBucket struct {
+	Min   string `json:"min"`
+	Max   string `json:"max,omitempty"`
+	Count int    `json:"count"`
+}
+
+// AgeHistogram sorts sub's unacked messages into buckets by how long before now they were published. bounds are the ascending upper bounds of every bucket but the last, which holds everything older. Messages whose files have already gone are not counted.
+func AgeHistogram(sub *Subscription, bounds []time.Duration, now time.Time) []AgeBucket {
+	sub.RLock()
+	ids := append([]uint64{}, sub.UnAcked...)
+	sub.RUnlock()
+	buckets := make([]AgeBucket, len(bounds)+1)
+	var min time.Duration
+	for i, max := range bounds {
+		buckets[i] = AgeBucket{Min: min.String(), Max: max.String()}
+		min = max
+	}
+	buckets[len(bounds)] = AgeBucket{Min: min.String()}
+	for _, id := range ids {
+		fi, err := os.Stat(messagePath(id))
+		if err != nil {
+			continue
+		}
+		age := now.Sub(fi.ModTime())
+		i := sort.Search(len(bounds), func(i int) bool { return age < bounds[i] })
+		buckets[i].Count++
+	}
+	return buckets
+}
+
+// MessageInfo describes the delivery state of a single stored message.
+type MessageInfo struct {
+	MessageMetadata
+	UnAckedBy []string `json:"unacked_by"`
+}
+
+// InspectMessage reports where message id is still waiting to be acked. It returns an error satisfying os.IsNotExist if the message is not stored.
+func InspectMessage(id uint64) (MessageInfo, error) {
+	metadata, err := GetMessageMetadata([]uint64{id})
+	if err != nil {
+		return MessageInfo{}, err
+	}
+	return MessageInfo{metadata[0], UnAckedBy(id)}, nil
+}
+
+// UnAckedBy returns the sorted names of the subscriptions still holding message id unacked.
+func UnAckedBy(id uint64) []string {
+	names := make([]string, 0)
+	subsMu.RLock()
+	defer subsMu.RUnlock()
+	for name, sub := range subs {
+		sub.RLock()
+		for _, unacked := range sub.UnAcked {
+			if unacked == id {
+				names = append(names, name)
+				break
+			}
+		}
+		sub.RUnlock()
+	}
+	sort.Strings(names)
+	return names
+}
+
+// AckMessages removes ids from the topic priority queue of unacked messages and returns how many were removed.
+func AckMessages(ids []uint64, sub *Subscription) int {
+	idMap := make(map[uint64]bool)
+	for _, k := range ids {
+		idMap[k] = true
+	}
+
+	sub.Lock()
+	acked := sub.removeMatching(func(id uint64) bool { return idMap[id] })
+	sub.Unlock()
+	sub.syncWAL()
+	atomic.AddUint64(&counters.MessagesAcked, uint64(len(acked)))
+	SendReceipts(sub.Name(), acked, clock.Now())
+	NotifyAcked(sub, acked)
+	return len(acked)
+}
+
+// released accounts for ids taken out of sub's backlog other than by an ack: they no longer count as held for receipts, and a sender waiting for sub to ack them stops waiting.
+func released(sub *Subscription, ids []uint64) {
+	DropReceipts(ids)
+	NotifyDropped(sub, ids)
+}
+
+// TrimMessages acks every message in sub's backlog that was published before the given time and returns how many were acked.
+func TrimMessages(sub *Subscription, before time.Time) int {
+	sub.RLock()
+	candidates := make([]uint64, len(sub.UnAcked))
+	copy(candidates, sub.UnAcked)
+	sub.RUnlock()
+
+	// Stat outside the lock; anything acked meanwhile is simply not found by AckMessages.
+	old := make([]uint64, 0)
+	for _, id := range candidates {
+		fi, err := os.Stat(messagePath(id))
+		if err != nil {
+			continue
+		}
+		if fi.ModTime().Before(before) {
+			old = append(old, id)
+		}
+	}
+	return AckMessages(old, sub)
+}
+
+// CompactSubscription drops ids from sub's backlog whose message files no longer exist, then copies the heap into a slice of exactly its length so spare capacity is released. It returns how many dangling ids were dropped.
+func CompactSubscription(sub *Subscription) int {
+	sub.RLock()
+	candidates := make([]uint64, len(sub.UnAcked))
+	copy(candidates, sub.UnAcked)
+	sub.RUnlock()
+
+	dangling := make(map[uint64]bool)
+	for _, id := range candidates {
+		if _, err := os.Stat(messagePath(id)); os.IsNotExist(err) {
+			dangling[id] = true
+		}
+	}
+
+	defer sub.syncWAL()
+	sub.Lock()
+	defer sub.Unlock()
+	dropped := sub.removeMatching(func(id uint64) bool { return dangling[id] })
+	released(sub, dropped)
+	compacted := make(MessageQueue, len(sub.UnAcked))
+	copy(compacted, sub.UnAcked)
+	sub.UnAcked = compacted
+	return len(dropped)
+}
+
+// ReplayMessages re-queues on sub every stored message published in [from, to) that it does not already hold and accepts. It also returns how many ids within the replayed range are no longer in storage, having been reaped or never written. A bounded sub is refused with errBounded.
+func ReplayMessages(sub *Subscription, from, to time.Time) (replayed, missing int, err error) {
+	if sub.bounded() {
+		return 0, 0, errBounded
+	}
+	reclaimMu.RLock()
+	defer reclaimMu.RUnlock()
+	stored, err := listStoredMessages()
+	if err != nil {
+		return 0, 0, err
+	}
+	now := clock.Now()
+	selected := make([]storedMessage, 0)
+	for _, m := range stored {
+		if !m.PublishedAt.Before(from) && m.PublishedAt.Before(to) && !IsExpired(m.ID, now) {
+			selected = append(selected, m)
+		}
+	}
+	if len(selected) == 0 {
+		return 0, 0, nil
+	}
+	missing = int(selected[len(selected)-1].ID-selected[0].ID+1) - len(selected)
+	routed := selected[:0]
+	for _, m := range selected {
+		meta, err := ReadMessageMeta(m.ID)
+		if err == nil && meta.Size != nil {
+			m.Size = *meta.Size
+		}
+		if err == nil && !meta.RoutedTo(sub) {
+			continue
+		}
+		routed = append(routed, m)
+	}
+	selected = routed
+
+	defer sub.syncWAL()
+	sub.Lock()
+	defer sub.Unlock()
+	held := make(map[uint64]bool, len(sub.UnAcked))
+	for _, id := range sub.UnAcked {
+		held[id] = true
+	}
+	for _, m := range selected {
+		if !held[m.ID] && sub.Accepts(int(m.Size)) {
+			sub.push(m.ID)
+			replayed++
+		}
+	}
+	return replayed, missing, nil
+}
+
+// TransferMessages moves ids from one subscription's backlog to another's and returns how many moved. Ids that from does not hold are ignored, and those too big for to's max_message_bytes stay where they are. A bounded to is refused with errBounded. Both subscriptions are locked for the whole move, always in order of seq, which unlike a name cannot change meanwhile, so concurrent transfers cannot deadlock.
+func TransferMessages(from, to *Subscription, ids []uint64) (int, error) {
+	if to.bounded() {
+		return 0, errBounded
+	}
+	if from == to {
+		return 0, nil
+	}
+	wanted := make(map[uint64]bool, len(ids))
+	for _, id := range ids {
+		if to.Options.MaxMessageBytes > 0 {
+			// Sized before locking, as that reads from storage.
+			if fi, err := os.Stat(messagePath(id)); err == nil && !to.Accepts(int(storedBodySize(id, fi.Size()))) {
+				continue
+			}
+		}
+		wanted[id] = true
+	}
+	first, second := from, to
+	if second.seq < first.seq {
+		first, second = second, first
+	}
+	reclaimMu.RLock()
+	defer reclaimMu.RUnlock()
+	defer from.syncWAL()
+	defer to.syncWAL()
+	first.Lock()
+	defer first.Unlock()
+	second.Lock()
+	defer second.Unlock()
+
+	held := make(map[uint64]bool, len(to.UnAcked))
+	for _, id := range to.UnAcked {
+		held[id] = true
+	}
+	moved := from.removeMatching(func(id uint64) bool { return wanted[id] })
+	for _, id := range moved {
+		if !held[id] {
+			to.push(id)
+		}
+	}
+	// Pushing first keeps the receipt counts of moved ids from touching zero.
+	released(from, moved)
+	return len(moved), nil
+}
+
+// UnAckedStatus reports, for each of ids, whether it is still waiting to be acked by sub.
+func UnAckedStatus(sub *Subscription, ids []uint64) map[uint64]bool {
+	status := make(map[uint64]bool, len(ids))
+	for _, id := range ids {
+		status[id] = false
+	}
+	sub.RLock()
+	defer sub.RUnlock()
+	for _, id := range sub.UnAcked {
+		if _, ok := status[id]; ok {
+			status[id] = true
+		}
+	}
+	return status
+}
+
+// JSONResponse  is a type that gives shape to our HTTP response JSON.
+type JSONResponse struct {
+	NMessage   int               `json:"n_messages"`
+	Messages   map[uint64]string `json:"messages"`
+	ServerTime time.Time         `json:"server_time"`
+	Missing    []uint64          `json:"missing,omitempty"` // Ids that could not be read, with -pull-error-mode skip.
+}
+
+// ClientCommonName returns the common name of the verified client certificate, or "" if the request was not made over mutual TLS.
+func ClientCommonName(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return ""
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName
+}
+
+// loadClientCAs reads a PEM bundle of CA certificates used to verify client certificates.
+func loadClientCAs(filename string) (*x509.CertPool, error) {
+	bs, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bs) {
+		return nil, fmt.Errorf("no certificates found in %s", filename)
+	}
+	return pool, nil
+}
+
+// Error codes are stable identifiers clients can switch on in error responses.
+const (
+	ErrMethodNotAllowed = "method_not_allowed"
+	ErrInvalidSub       = "invalid_sub"
+	ErrInvalidN         = "invalid_n"
+	ErrInvalidFormat    = "invalid_format"
+	ErrInvalidID        = "invalid_id"
+	ErrInvalidOption    = "invalid_option"
+	ErrInvalidMessage   = "invalid_message"
+	ErrInvalidForm      = "invalid_form"
+	ErrSubExists        = "sub_exists"
+	ErrSubLimit         = "subscription_limit"
+	ErrRateLimited      = "rate_limited"
+	ErrBacklogFull      = "backlog_full"
+	ErrNotFound         = "not_found"
+	ErrUnauthorized     = "unauthorized"
+	ErrForbidden        = "forbidden"
+	ErrStorage          = "storage_error"
+	ErrUnavailable      = "unavailable"
+	ErrInternal         = "internal_error"
+)
+
+// JSONError is the body of every error response: {"error":{"code":...,"message":...}}.
+type JSONError struct {
+	Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// allowMethods reports whether r uses one of methods. If not, it answers 405 with an Allow header listing them.
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, ErrMethodNotAllowed, fmt.Sprintf("method must be %s", strings.Join(methods, " or ")))
+	return false
+}
+
+// parseForm parses r's query and body into r.Form. If either is malformed it answers 400 and returns false.
+func parseForm(w http.ResponseWriter, r *http.Request) bool {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, ErrInvalidForm, fmt.Sprintf("could not parse request form: %v", err))
+		return false
+	}
+	return true
+}
+
+// writeError writes status and a JSONError body.
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	var e JSONError
+	e.Error.Code = code
+	e.Error.Message = message
+	bs, _ := json.Marshal(e)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(bs)
+	w.Write([]byte("\n"))
+}
+
+// writeBacklogFull answers a send refused because sub holds more than max unacked messages.
+func writeBacklogFull(w http.ResponseWriter, sub *Subscription, max int) {
+	writeError(w, http.StatusTooManyRequests, ErrBacklogFull, fmt.Sprintf("subscription %q has more than %d unacked messages", sub.Name(), max))
+}
+
+// writeBody writes a 200 response of bs plus a trailing newline. When bs has room for the newline it all goes in a single write, without copying bs. Setting Content-Length up front also spares large bodies from chunked encoding.
+func writeBody(w http.ResponseWriter, bs []byte) {
+	w.Header().Set("Content-Length", strconv.Itoa(len(bs)+1))
+	w.WriteHeader(http.StatusOK)
+	if cap(bs) > len(bs) {
+		w.Write(append(bs, '\n'))
+		return
+	}
+	w.Write(bs)
+	w.Write([]byte("\n"))
+}
+
+// writeTar streams messages as a tar archive with one entry per message, named by its id, in the order of metadata. Message metadata goes in each entry's PAX records.
+func writeTar(w http.ResponseWriter, metadata []MessageMetadata, messages map[uint64]string) error {
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.WriteHeader(http.StatusOK)
+	tw := tar.NewWriter(w)
+	for _, md := range metadata {
+		records := map[string]string{
+			"PUBSUBD.published_at": md.PublishedAt.Format(time.RFC3339Nano),
+		}
+		if md.ExpiresAt != nil {
+			records["PUBSUBD.expires_at"] = md.ExpiresAt.Format(time.RFC3339Nano)
+		}
+		body := messages[md.ID]
+		hdr := &tar.Header{
+			Name:       strconv.FormatUint(md.ID, 10),
+			Mode:       0644,
+			Size:       int64(len(body)),
+			ModTime:    md.PublishedAt,
+			Format:     tar.FormatPAX,
+			PAXRecords: records,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(tw, body); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// serveHealthDetail answers /healthz?verbose=true.
+func serveHealthDetail(w http.ResponseWriter, r *http.Request) {
+	detail := CheckHealth()
+	bs, err := json.Marshal(detail)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, ErrInternal, err.Error())
+		return
+	}
+	status := http.StatusOK
+	if !detail.Healthy {
+		status = http.StatusServiceUnavailable
+	}
+	w.WriteHeader(status)
+	w.Write(bs)
+	w.Write([]byte("\n"))
+}
+
+// removeStaleSocket removes a Unix socket left behind by a previous run. It refuses to remove anything that is not a socket.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	return os.Remove(path)
+}
+
+func marshall(messages map[uint64]string, missing []uint64) ([]byte, error) {
+	return json.Marshal(JSONResponse{len(messages), messages, clock.Now(), missing})
+}
+
+// JSONMessage is a single element of an array-format pull response.
+type JSONMessage struct {
+	ID   uint64 `json:"id"`
+	Body string `json:"body"`
+	Size int    `json:"size"`
+}
+
+// JSONArrayResponse is the shape of a pull response requested with format=array. Messages are in ascending id order.
+type JSONArrayResponse struct {
+	NMessage   int           `json:"n_messages"`
+	Messages   []JSONMessage `json:"messages"`
+	ServerTime time.Time     `json:"server_time"`
+	Missing    []uint64      `json:"missing,omitempty"`
+}
+
+// JSONMetadataResponse is the shape of a pull response requested with bodies=false.
+type JSONMetadataResponse struct {
+	NMessage   int               `json:"n_messages"`
+	Messages   []MessageMetadata `json:"messages"`
+	ServerTime time.Time         `json:"server_time"`
+}
+
+func marshallArray(ids []uint64, messages map[uint64]string, missing []uint64) ([]byte, error) {
+	ordered := make([]JSONMessage, 0, len(ids))
+	for _, id := range ids {
+		ordered = append(ordered, JSONMessage{id, messages[id], len(messages[id])})
+	}
+	return json.Marshal(JSONArrayResponse{len(ordered), ordered, clock.Now(), missing})
+}
+
+// streamMessages writes the response marshall, or marshallArray if array is true, would produce for ids pulled from sub, reading each body from storage only as it is written, so a huge pull holds one body in memory at a time. n_messages, written first, promises every one of ids, so a message that can no longer be read, even one that vanished since the pull picked it, ends the response early. Once writing has started a read error cannot change the status, so it is returned for the caller to abandon the response.
+func streamMessages(w http.ResponseWriter, sub *Subscription, ids []uint64, array bool) error {
+	order := ids
+	open, close := byte('{'), byte('}')
+	if array {
+		open, close = '[', ']'
+	} else {
+		// encoding/json writes map keys sorted as strings, so "10" comes before "2".
+		order = make([]uint64, len(ids))
+		copy(order, ids)
+		sort.Slice(order, func(i, j int) bool {
+			return strconv.FormatUint(order[i], 10) < strconv.FormatUint(order[j], 10)
+		})
+	}
+	w.WriteHeader(http.StatusOK)
+	bw := bufio.NewWriter(w)
+	// Each value is encoded into buf and copied out without the newline Encode ends it with, so the output matches json.Marshal's.
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	encode := func(v interface{}) error {
+		buf.Reset()
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+		_, err := bw.Write(bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+		return err
+	}
+	fmt.Fprintf(bw, `{"n_messages":%d,"messages":%c`, len(order), open)
+	for i, id := range order {
+		body, err := getMessage(id)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			bw.WriteByte(',')
+		}
+		if array {
+			err = encode(JSONMessage{id, body, len(body)})
+		} else {
+			fmt.Fprintf(bw, `"%d":`, id)
+			err = encode(body)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(bw, `%c,"server_time":`, close)
+	if err := encode(clock.Now()); err != nil {
+		return err
+	}
+	bw.WriteString("}\n")
+	return bw.Flush()
+}
+
+// maxSuggestedGrowth bounds how many times larger than the current batch X-Suggested-N may be.
+const maxSuggestedGrowth = 4
+
+// recordPull notes a pull at now and returns the moving average interval between pulls, or 0 after the first.
+func (sub *Subscription) recordPull(now time.Time) time.Duration {
+	last := atomic.SwapInt64(&sub.lastPull, now.UnixNano())
+	if last == 0 {
+		return 0
+	}
+	interval := now.UnixNano() - last
+	if avg := atomic.LoadInt64(&sub.pullInterval); avg != 0 {
+		interval = (3*avg + interval) / 4
+	}
+	atomic.StoreInt64(&sub.pullInterval, interval)
+	return time.Duration(interval)
+}
+
+// SuggestBatchSize advises how many messages the next pull should ask for, given the n just asked for, the backlog left behind it, and how often the subscription is pulled. A deep backlog suggests the batch that would drain it in about a second at the current pace, up to maxSuggestedGrowth times n; otherwise n stays as it is.
+func SuggestBatchSize(n, remaining int, interval time.Duration) int {
+	if n < 1 {
+		n = 1
+	}
+	if remaining <= n {
+		return n
+	}
+	suggested := remaining
+	if interval > 0 && interval < time.Second {
+		suggested = int(int64(remaining) * int64(interval) / int64(time.Second))
+	}
+	if suggested > maxSuggestedGrowth*n {
+		suggested = maxSuggestedGrowth * n
+	}
+	if suggested < n {
+		suggested = n
+	}
+	return suggested
+}
+
+// SubscriptionStats describes a single subscription in /stats and /subscriptions responses.
+type SubscriptionStats struct {
+	Backlog          int                 `json:"backlog"`
+	Cursor           uint64              `json:"cursor"`
+	CreatedAt        time.Time           `json:"created_at"`
+	AgeSeconds       float64             `json:"age_seconds"`
+	LastActive       time.Time           `json:"last_active"`
+	Paused           bool                `json:"paused"`
+	Skipped          uint64              `json:"skipped"`
+	Dropped          uint64              `json:"dropped"`
+	Coalesced        uint64              `json:"coalesced"`
+	Transient        int                 `json:"transient"`
+	TransientDropped uint64              `json:"transient_dropped"`
+	RateLimit        float64             `json:"rate_limit"`
+	PullRate         float64             `json:"pull_rate"`
+	Options          SubscriptionOptions `json:"options"`
+}
+
+// Stats describes the subscription's current state.
+func (sub *Subscription) Stats() SubscriptionStats {
+	sub.RLock()
+	defer sub.RUnlock()
+	stats := SubscriptionStats{
+		Backlog:    len(sub.UnAcked),
+		Cursor:     sub.Cursor,
+		CreatedAt:  sub.CreatedAt,
+		AgeSeconds: clock.Now().Sub(sub.CreatedAt).Seconds(),
+		LastActive: sub.LastActive(),
+		Paused:     sub.Paused,
+		Skipped:    sub.Skipped,
+		Dropped:    sub.Dropped,
+		Coalesced:  sub.Coalesced,
+		RateLimit:  sub.RateLimit(),
+		PullRate:   sub.pullRate(clock.Now()),
+		Options:    sub.Options,
+	}
+	if sub.transient != nil {
+		stats.Transient = sub.transient.Len()
+		stats.TransientDropped = sub.transient.Dropped
+	}
+	return stats
+}
+
+// SubscriptionsResponse gives shape to the /subscriptions JSON.
+type SubscriptionsResponse struct {
+	NSubscription int                          `json:"n_subscriptions"`
+	Subscriptions map[string]SubscriptionStats `json:"subscriptions"`
+}
+
+// ListSubscriptions describes every current subscription.
+func ListSubscriptions() map[string]SubscriptionStats {
+	subsMu.RLock()
+	defer subsMu.RUnlock()
+	list := make(map[string]SubscriptionStats, len(subs))
+	for name, sub := range subs {
+		list[name] = sub.Stats()
+	}
+	return list
+}
+
+// SetPaused pauses or resumes delivery to sub.
+func SetPaused(sub *Subscription, paused bool) {
+	sub.Lock()
+	sub.Paused = paused
+	sub.snapshotLater()
+	sub.Unlock()
+	sub.syncWAL()
+}
+
+// StatsResponse gives shape to the /stats JSON.
+type StatsResponse struct {
+	ServerTime    time.Time                    `json:"server_time"`
+	NextMessageID uint64                       `json:"next_message_id"`
+	MessagesSent  uint64                       `json:"messages_sent"`
+	MessagesAcked uint64                       `json:"messages_acked"`
+	Pulls         uint64                       `json:"pulls"`
+	Corrupt       uint64                       `json:"corrupt_reads"`
+	NSubscription int                          `json:"n_subscriptions"`
+	BacklogTotal  int                          `json:"backlog_total"`
+	StorageState  string                       `json:"storage_breaker"`
+	BodyBytes     uint64                       `json:"body_bytes"`
+	StoredBytes   uint64                       `json:"stored_bytes"`
+	Compression   float64                      `json:"compression_ratio"` // BodyBytes / StoredBytes, or 0 before anything is stored.
+	CacheHits     uint64                       `json:"cache_hits"`
+	CacheMisses   uint64                       `json:"cache_misses"`
+	DiskReads     uint64                       `json:"disk_reads"`
+	SharedReads   uint64                       `json:"shared_reads"`
+	InFlight      int64                        `json:"in_flight"`
+	Connections   ConnStats                    `json:"connections"`
+	Subscriptions map[string]SubscriptionStats `json:"subscriptions"`
+}
+
+// GetStats collects counters and per-subscription backlog sizes.
+func GetStats() StatsResponse {
+	topic.RLock()
+	stats := StatsResponse{
+		ServerTime:    clock.Now(),
+		NextMessageID: topic.NextMesgID,
+		MessagesSent:  atomic.LoadUint64(&counters.MessagesSent),
+		MessagesAcked: atomic.LoadUint64(&counters.MessagesAcked),
+		Pulls:         atomic.LoadUint64(&counters.Pulls),
+		Corrupt:       atomic.LoadUint64(&counters.Corrupt),
+		StorageState:  storageBreaker.State(),
+		BodyBytes:     atomic.LoadUint64(&counters.BodyBytes),
+		StoredBytes:   atomic.LoadUint64(&counters.StoredBytes),
+		CacheHits:     atomic.LoadUint64(&messageCache.Hits),
+		CacheMisses:   atomic.LoadUint64(&messageCache.Misses),
+		DiskReads:     atomic.LoadUint64(&counters.DiskReads),
+		SharedReads:   atomic.LoadUint64(&counters.SharedReads),
+		InFlight:      atomic.LoadInt64(&inFlight),
+		Connections:   connTracker.Stats(),
+		Subscriptions: ListSubscriptions(),
+	}
+	topic.RUnlock()
+
+	if stats.StoredBytes > 0 {
+		stats.Compression = float64(stats.BodyBytes) / float64(stats.StoredBytes)
+	}
+	stats.NSubscription = len(stats.Subscriptions)
+	for _, s := range stats.Subscriptions {
+		stats.BacklogTotal += s.Backlog
+	}
+	return stats
+}
+
+func main() {
+	flag.Parse()
+	log.SetOutput(io.MultiWriter(os.Stderr, logHub))
+	if *configFilename != "" {
+		if err := LoadConfig(*configFilename); err != nil {
+			log.Fatalf("While loading config: %v", err)
+		}
+	}
+	if *aclFilename != "" {
+		if err := LoadACL(*aclFilename); err != nil {
+			log.Fatalf("While loading ACL: %v", err)
+		}
+		ReloadACLOnHangup(*aclFilename)
+	}
+	if *signingKeyFilename != "" {
+		if err := LoadSigningKey(*signingKeyFilename); err != nil {
+			log.Fatalf("While loading signing key: %v", err)
+		}
+	}
+	rand.Seed(time.Now().UnixNano())
+	var err error
+	if messageValidator, err = NewMessageValidator(*validate); err != nil {
+		log.Fatalf("While parsing -validate: %v", err)
+	}
+	if err := os.MkdirAll(*dataDirname, 0755); err != nil {
+		log.Fatalf("While creating data directory: %v", err)
+	}
+	if err := RecoverNextMessageID(); err != nil {
+		log.Fatalf("While scanning data directory: %v", err)
+	}
+	if err := LoadMessageMeta(); err != nil {
+		log.Fatalf("While loading message metadata: %v", err)
+	}
+	if *reapInterval <= 0 {
+		log.Fatalf("-reap-interval must be positive, not %v", *reapInterval)
+	}
+	StartReaper(*reapInterval)
+	if *webhookURL != "" {
+		StartWatermarkMonitor(*webhookURL, *watermarkInterval)
+	}
+	messageCache = NewMessageCache(*cacheBytes)
+	storageBreaker.Threshold = *breakerThreshold
+	storageBreaker.Cooldown = *breakerCooldown
+	if *compressStorage != "" && *compressStorage != "gzip" {
+		log.Fatalf("Unknown -compress-storage encoding %q", *compressStorage)
+	}
+	if *receiptMode != "each" && *receiptMode != "all" {
+		log.Fatalf("Unknown -receipt-mode %q", *receiptMode)
+	}
+	if *implicitSubs != "on" && *implicitSubs != "ack-only" && *implicitSubs != "off" {
+		log.Fatalf("Unknown -implicit-subs policy %q", *implicitSubs)
+	}
+	if *pullErrorMode != "fail" && *pullErrorMode != "skip" {
+		log.Fatalf("Unknown -pull-error-mode %q", *pullErrorMode)
+	}
+	if *emptyPullStatus != http.StatusOK && *emptyPullStatus != http.StatusNoContent {
+		log.Fatalf("-empty-pull-status must be 200 or 204, not %d", *emptyPullStatus)
+	}
+	if *subEviction != "reject" && *subEviction != "lru" {
+		log.Fatalf("Unknown -sub-eviction policy %q", *subEviction)
+	}
+	if *walEnabled {
+		if err := LoadSubscriptions(); err != nil {
+			log.Fatalf("While recovering subscriptions: %v", err)
+		}
+	}
+	RecountReceipts()
+	if *receiptWorkers <= 0 || *receiptQueue < 0 {
+		log.Fatalf("-receipt-workers must be positive and -receipt-queue not negative")
+	}
+	StartReceiptWorkers(*receiptWorkers, *receiptQueue)
+	StartNotifyWorkers(*notifyWorkers, *notifyQueue)
+
+	http.HandleFunc("/send", Authorize(PermPublish, func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodPost) {
+			return
+		}
+		if !parseForm(w, r) {
+			return
+		}
+		messages := r.Form["message"]
+		if i := FindInvalidMessage(messages); i >= 0 {
+			writeError(w, http.StatusBadRequest, ErrInvalidMessage, fmt.Sprintf("message %d failed validation", i))
+			return
+		}
+		metas, err := ParseMessageMeta(r, len(messages), clock.Now())
+		if err != nil {
+			writeError(w, http.StatusBadRequest, ErrInvalidOption, err.Error())
+			return
+		}
+		var targets []*Subscription
+		if names := r.Form["to_sub"]; len(names) > 0 {
+			targets = make([]*Subscription, 0, len(names))
+			routes := make([]string, 0, len(names))
+			for _, name := range names {
+				// Creating a subscription, which may evict another, takes the right to pull from it, not just to publish.
+				sub, ok := GetSubscriptionNamed(w, name, implicitCreate(false) && Permits(r, PermPull, name))
+				if !ok {
+					return
+				}
+				if !Routed(routes, name) {
+					targets = append(targets, sub)
+					routes = append(routes, name)
+				}
+			}
+			for i := range metas {
+				metas[i].ToSubs = routes
+			}
+		}
+		var selector Labels
+		if s := r.Form.Get("selector"); s != "" {
+			if selector, err = ParseLabels(s); err != nil {
+				writeError(w, http.StatusBadRequest, ErrInvalidOption, err.Error())
+				return
+			}
+			for i := range metas {
+				metas[i].Selector = selector
+			}
+		}
+		routing := Routing{Targets: targets, Selector: selector, RejectBacklog: -1}
+		if s := r.Form.Get("reject_backlog"); s != "" {
+			max, err := strconv.Atoi(s)
+			if err != nil || max < 0 {
+				writeError(w, http.StatusBadRequest, ErrInvalidOption, fmt.Sprintf("invalid reject_backlog %q", s))
+				return
+			}
+			routing.RejectBacklog = max
+			if names := r.Form["backlog_sub"]; len(names) > 0 {
+				routing.Watched = make([]*Subscription, 0, len(names))
+				for _, name := range names {
+					sub, ok := GetSubscriptionNamed(w, name, false)
+					if !ok {
+						return
+					}
+					routing.Watched = append(routing.Watched, sub)
+				}
+			}
+		}
+		if r.Form.Get("transient") == "true" {
+			for _, option := range []string{"ttl", "receipt_url", "wait_for_delivery", "wait_for_all"} {
+				if _, ok := r.Form[option]; ok {
+					writeError(w, http.StatusBadRequest, ErrInvalidOption, fmt.Sprintf("%s cannot be used with transient messages", option))
+					return
+				}
+			}
+			recipients := targets
+			if selector != nil {
+				recipients = SelectSubscriptions(targets, selector)
+			}
+			if routing.RejectBacklog >= 0 {
+				watched := routing.Watched
+				if watched == nil {
+					watched = recipients
+				}
+				if sub := BackedUp(watched, routing.RejectBacklog); sub != nil {
+					writeBacklogFull(w, sub, routing.RejectBacklog)
+					return
+				}
+			}
+			DeliverTransient(messages, recipients)
+			atomic.AddUint64(&counters.MessagesSent, uint64(len(messages)))
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		dedup := r.Form.Get("dedup_batch") == "true"
+		waitForDelivery := r.Form.Get("wait_for_delivery") == "true"
+		waitForAll := r.Form.Get("wait_for_all") == "true"
+		if waitForDelivery && waitForAll {
+			writeError(w, http.StatusBadRequest, ErrInvalidOption, "wait_for_delivery and wait_for_all cannot be combined")
+			return
+		}
+		waitTimeout := defaultDeliveryWait
+		if s := r.Form.Get("wait_timeout"); s != "" {
+			waitTimeout, err = time.ParseDuration(s)
+			if err != nil || waitTimeout <= 0 || waitTimeout > *maxDeliveryWait {
+				writeError(w, http.StatusBadRequest, ErrInvalidOption, fmt.Sprintf("invalid wait_timeout %q, want a duration up to %s", s, *maxDeliveryWait))
+				return
+			}
+		}
+		var positions []int
+		if dedup {
+			messages, metas, positions = DedupBatch(messages, metas)
+		}
+		baseID, recipients, backedUp := CreateMessageIds(len(messages), routing)
+		if backedUp != nil {
+			writeBacklogFull(w, backedUp, routing.RejectBacklog)
+			return
+		}
+		// Allow hands out the half-open probe, which only Record gives back, so an empty send, which writes nothing, must not take it.
+		if len(messages) > 0 && !storageBreaker.Allow() {
+			releaseBatch(baseID, recipients, len(messages))
+			writeError(w, http.StatusServiceUnavailable, ErrUnavailable, "storage is failing; try again later")
+			return
+		}
+		var watch *DeliveryWatch
+		if waitForDelivery {
+			watch = WatchDelivery(baseID, len(messages))
+		}
+		var ackWatch *AckWatch
+		if waitForAll {
+			ackWatch = WatchAcks(baseID, len(messages), recipients)
+		}
+		if err := PutMessages(messages, metas, baseID, recipients); err != nil {
+			if watch != nil {
+				watch.Cancel()
+			}
+			if ackWatch != nil {
+				ackWatch.Cancel()
+			}
+			writeError(w, http.StatusInternalServerError, ErrStorage, "could not store messages")
+			return
+		}
+		atomic.AddUint64(&counters.MessagesSent, uint64(len(messages)))
+		status := http.StatusOK
+		if len(r.Form["message"]) == 1 {
+			// A single message is a created resource, and can be inspected at /message.
+			w.Header().Set("Location", fmt.Sprintf("/message?id=%d", baseID))
+			status = http.StatusCreated
+		}
+		if positions == nil {
+			positions = make([]int, len(messages))
+			for i := range positions {
+				positions[i] = i
+			}
+		}
+		var resp struct {
+			IDs       []uint64        `json:"ids"`
+			Delivered []bool          `json:"delivered,omitempty"`
+			Acked     map[string]bool `json:"acked,omitempty"`
+		}
+		resp.IDs = make([]uint64, len(positions))
+		for i, p := range positions {
+			resp.IDs[i] = baseID + uint64(p)
+		}
+		if waitForDelivery {
+			var delivered []bool
+			idle(r, func() { delivered = watch.Wait(waitTimeout) })
+			resp.Delivered = make([]bool, len(positions))
+			for i, p := range positions {
+				resp.Delivered[i] = delivered[p]
+			}
+		}
+		if waitForAll {
+			if !asyncFanout(len(recipients)) {
+				// Delivery has finished, so a recipient not holding a message was never given it.
+				for _, sub := range recipients {
+					ackWatch.Undelivered(sub)
+				}
+			}
+			idle(r, func() { resp.Acked = ackWatch.Wait(waitTimeout) })
+		}
+		bs, err := json.Marshal(resp)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, ErrInternal, err.Error())
+			return
+		}
+		w.WriteHeader(status)
+		w.Write(bs)
+		w.Write([]byte("\n"))
+	}))
+
+	http.HandleFunc("/unsub", Authorize(PermPull, func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodPost) {
+			return
+		}
+		if !parseForm(w, r) {
+			return
+		}
+		if r.Form.Get("prefix") == "true" {
+			prefix := r.Form.Get("sub")
+			if prefix == "" && r.Form.Get("confirm") != "true" {
+				writeError(w, http.StatusBadRequest, ErrInvalidSub, "an empty prefix destroys every subscription; pass confirm=true to do that")
+				return
+			}
+			if prefix != "" && !validSubRegexp.MatchString(prefix) {
+				writeError(w, http.StatusBadRequest, ErrInvalidSub, fmt.Sprintf("invalid subscription prefix %q", prefix))
+				return
+			}
+			destroyed := DestroySubscriptionsMatching(func(name string) bool {
+				return strings.HasPrefix(name, prefix) && Permits(r, PermPull, name)
+			})
+			bs, err := json.Marshal(struct {
+				NDestroyed int      `json:"n_destroyed"`
+				Destroyed  []string `json:"destroyed"`
+			}{len(destroyed), destroyed})
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, ErrInternal, err.Error())
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			w.Write(bs)
+			w.Write([]byte("\n"))
+			return
+		}
+		sub, ok := GetSubscription(w, r, implicitCreate(false))
+		if !ok {
+			return
+		}
+		DestroySubscription(sub)
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	http.HandleFunc("/checksub", Authorize(PermPull, func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodGet, http.MethodHead) {
+			return
+		}
+		if !parseForm(w, r) {
+			return
+		}
+		name := r.Form.Get("sub")
+		_, exists := LookupSubscription(name)
+		bs, err := json.Marshal(struct {
+			Valid  bool `json:"valid"`
+			Exists bool `json:"exists"`
+		}{validSubRegexp.MatchString(name), exists})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, ErrInternal, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write(bs)
+		w.Write([]byte("\n"))
+	}))
+
+	http.HandleFunc("/createsub", Authorize(PermPull, func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodPost) {
+			return
+		}
+		if !parseForm(w, r) {
+			return
+		}
+		name := r.Form.Get("sub")
+		if !validSubRegexp.MatchString(name) {
+			writeError(w, http.StatusBadRequest, ErrInvalidSub, fmt.Sprintf("invalid subscription name %q", name))
+			return
+		}
+		opts, err := ParseSubscriptionOptions(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, ErrInvalidOption, err.Error())
+			return
+		}
+		if _, err := CreateSubscription(name, opts); err == errSubExists {
+			writeError(w, http.StatusConflict, ErrSubExists, fmt.Sprintf("subscription %q already exists", name))
+			return
+		} else if err == errSubLimit {
+			writeError(w, http.StatusTooManyRequests, ErrSubLimit, fmt.Sprintf("subscription limit of %d reached", *maxSubs))
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+
+	for path, paused := range map[string]bool{"/pause": true, "/resume": false} {
+		paused := paused
+		http.HandleFunc(path, Authorize(PermPull, func(w http.ResponseWriter, r *http.Request) {
+			if !allowMethods(w, r, http.MethodPost) {
+				return
+			}
+			if !parseForm(w, r) {
+				return
+			}
+			sub, ok := GetSubscription(w, r, implicitCreate(false))
+			if !ok {
+				return
+			}
+			SetPaused(sub, paused)
+			w.WriteHeader(http.StatusOK)
+		}))
+	}
+
+	http.HandleFunc("/pull", AuthorizeSigned(PermPull, func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodGet, http.MethodHead) {
+			return
+		}
+		if !parseForm(w, r) {
+			return
+		}
+		nMessageString := r.Form.Get("n")
+		nMessage, err := strconv.Atoi(nMessageString)
+		if err != nil || nMessage < 0 {
+			writeError(w, http.StatusBadRequest, ErrInvalidN, fmt.Sprintf("invalid message count %q", nMessageString))
+			return
+		}
+		format := r.Form.Get("format")
+		if format != "" && format != "map" && format != "array" {
+			writeError(w, http.StatusBadRequest, ErrInvalidFormat, fmt.Sprintf("unknown format %q", format))
+			return
+		}
+		onlyIDs := make([]uint64, 0)
+		for _, idString := range r.Form["only_id"] {
+			id, err := strconv.ParseUint(idString, 10, 64)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, ErrInvalidID, fmt.Sprintf("invalid message id %q", idString))
+				return
+			}
+			onlyIDs = append(onlyIDs, id)
+		}
+		bodies := true
+		if b := r.Form.Get("bodies"); b != "" {
+			if bodies, err = strconv.ParseBool(b); err != nil {
+				writeError(w, http.StatusBadRequest, ErrInvalidOption, fmt.Sprintf("invalid bodies %q", b))
+				return
+			}
+		}
+		// A probe reports on a subscription without creating one.
+		sub, ok := GetSubscription(w, r, implicitCreate(true) && r.Method != http.MethodHead)
+		if !ok {
+			return
+		}
+		if sub.Options.StrictOrder {
+			// Nothing past the lowest unacked message may be handed out until it is acked.
+			if len(onlyIDs) > 0 {
+				writeError(w, http.StatusBadRequest, ErrInvalidOption, "only_id cannot be used with a strict_order subscription")
+				return
+			}
+			if nMessage > 1 {
+				nMessage = 1
+			}
+		}
+		findIDs := func() []uint64 {
+			if len(onlyIDs) > 0 {
+				return FindSelectedMessageIds(sub, onlyIDs, nMessage)
+			}
+			return FindUnAckedMessageIds(sub, nMessage)
+		}
+		if r.Method == http.MethodHead {
+			// A probe: report what a pull would return without reading or counting anything.
+			w.Header().Set("X-Message-Count", strconv.Itoa(len(findIDs())))
+			w.Header().Set("X-Backlog", strconv.Itoa(sub.Stats().Backlog))
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		atomic.AddUint64(&counters.Pulls, 1)
+		now := clock.Now()
+		wanted := nMessage
+		if nMessage = sub.takeTokens(wanted, now); nMessage == 0 && wanted > 0 {
+			w.Header().Set("Retry-After", "1")
+			writeError(w, http.StatusTooManyRequests, ErrRateLimited, fmt.Sprintf("subscription is limited to %g messages per second", sub.RateLimit()))
+			return
+		}
+		if r.Form.Get("transient") == "true" {
+			messages := PullTransient(sub, nMessage)
+			sub.returnTokens(nMessage-len(messages), len(messages), now)
+			if len(messages) == 0 && *emptyPullStatus == http.StatusNoContent {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			bs, err := json.Marshal(struct {
+				NMessage   int       `json:"n_messages"`
+				Messages   []string  `json:"messages"`
+				ServerTime time.Time `json:"server_time"`
+			}{len(messages), messages, clock.Now()})
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, ErrInternal, err.Error())
+				return
+			}
+			writeBody(w, bs)
+			return
+		}
+		messageIDs := findIDs()
+		stream := bodies && *streamPullThreshold > 0 && len(messageIDs) > *streamPullThreshold && *maxPullBytes <= 0 &&
+			*pullErrorMode == "fail" && !strings.Contains(r.Header.Get("Accept"), "application/x-tar")
+		var messages map[uint64]string
+		var missing []uint64
+		if bodies && !stream {
+			var truncated bool
+			messages, messageIDs, missing, truncated, err = GetMessagesWithin(sub, messageIDs, *maxPullBytes, *pullErrorMode == "skip")
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, ErrStorage, "could not read messages")
+				return
+			}
+			if truncated {
+				w.Header().Set("X-Truncated", "true")
+			}
+		}
+		sub.returnTokens(nMessage-len(messageIDs), len(messageIDs), now)
+		interval := sub.recordPull(now)
+		remaining := sub.Stats().Backlog - len(messageIDs)
+		suggested := SuggestBatchSize(nMessage, remaining, interval)
+		if sub.Options.StrictOrder && suggested > 1 {
+			suggested = 1
+		}
+		w.Header().Set("X-Suggested-N", strconv.Itoa(suggested))
+		if len(messageIDs) == 0 && len(missing) == 0 && *emptyPullStatus == http.StatusNoContent {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if !bodies {
+			metadata, err := GetPulledMetadata(sub, messageIDs)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, ErrStorage, "could not read messages")
+				return
+			}
+			messageIDs = messageIDs[:0]
+			for _, md := range metadata {
+				messageIDs = append(messageIDs, md.ID)
+			}
+			NotifyPulled(messageIDs)
+			bs, err := json.Marshal(JSONMetadataResponse{len(metadata), metadata, clock.Now()})
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, ErrInternal, err.Error())
+				return
+			}
+			writeBody(w, bs)
+			return
+		}
+		NotifyPulled(messageIDs)
+		if stream {
+			if err := streamMessages(w, sub, messageIDs, format == "array"); err != nil {
+				log.Printf("While streaming pull for %s: %v", sub.Name(), err)
+				panic(http.ErrAbortHandler)
+			}
+			return
+		}
+		if strings.Contains(r.Header.Get("Accept"), "application/x-tar") {
+			metadata, err := GetPulledMetadata(sub, messageIDs)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, ErrStorage, "could not read messages")
+				return
+			}
+			if len(missing) > 0 {
+				ids := make([]string, len(missing))
+				for i, id := range missing {
+					ids[i] = strconv.FormatUint(id, 10)
+				}
+				w.Header().Set("X-Missing", strings.Join(ids, ","))
+			}
+			if err := writeTar(w, metadata, messages); err != nil {
+				log.Printf("While writing tar for %s: %v", sub.Name(), err)
+			}
+			return
+		}
+		var bs []byte
+		if format == "array" {
+			bs, err = marshallArray(messageIDs, messages, missing)
+		} else {
+			bs, err = marshall(messages, missing)
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, ErrInternal, err.Error())
+			return
+		}
+		writeBody(w, bs)
+	}))
+
+	http.HandleFunc("/ack", Authorize(PermPull, func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodPost) {
+			return
+		}
+		if !parseForm(w, r) {
+			return
+		}
+		sub, ok := GetSubscription(w, r, implicitCreate(false))
+		if !ok {
+			return
+		}
+
+		messageIDs := make([]uint64, 0, 16)
+		for _, idString := range r.Form["id"] {
+			id, err := strconv.ParseUint(idString, 10, 64)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, ErrInvalidID, fmt.Sprintf("invalid message id %q", idString))
+				return
+			}
+			messageIDs = append(messageIDs, uint64(id))
+		}
+		AckMessages(messageIDs, sub)
+	}))
+
+	http.HandleFunc("/trim", Authorize(PermPull, func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodPost) {
+			return
+		}
+		if !parseForm(w, r) {
+			return
+		}
+		sub, ok := GetSubscription(w, r, implicitCreate(false))
+		if !ok {
+			return
+		}
+		beforeString := r.Form.Get("before")
+		before, err := time.Parse(time.RFC3339Nano, beforeString)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, ErrInvalidOption, fmt.Sprintf("invalid before %q, want an RFC 3339 time", beforeString))
+			return
+		}
+		bs, err := json.Marshal(struct {
+			NTrimmed int `json:"n_trimmed"`
+		}{TrimMessages(sub, before)})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, ErrInternal, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write(bs)
+		w.Write([]byte("\n"))
+	}))
+
+	http.HandleFunc("/compact-sub", Authorize(PermPull, func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodPost) {
+			return
+		}
+		if !parseForm(w, r) {
+			return
+		}
+		sub, ok := GetSubscription(w, r, implicitCreate(false))
+		if !ok {
+			return
+		}
+		bs, err := json.Marshal(struct {
+			NDropped int `json:"n_dropped"`
+		}{CompactSubscription(sub)})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, ErrInternal, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write(bs)
+		w.Write([]byte("\n"))
+	}))
+
+	http.HandleFunc("/replay", Authorize(PermPull, func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodPost) {
+			return
+		}
+		if !parseForm(w, r) {
+			return
+		}
+		sub, ok := GetSubscription(w, r, implicitCreate(false))
+		if !ok {
+			return
+		}
+		var times [2]time.Time
+		for i, param := range []string{"from", "to"} {
+			t, err := time.Parse(time.RFC3339Nano, r.Form.Get(param))
+			if err != nil {
+				writeError(w, http.StatusBadRequest, ErrInvalidOption, fmt.Sprintf("invalid %s %q, want an RFC 3339 time", param, r.Form.Get(param)))
+				return
+			}
+			times[i] = t
+		}
+		replayed, missing, err := ReplayMessages(sub, times[0], times[1])
+		if err == errBounded {
+			writeError(w, http.StatusBadRequest, ErrInvalidOption, err.Error())
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, ErrStorage, "could not list stored messages")
+			return
+		}
+		if missing > 0 {
+			log.Printf("Replay of %s skipped %d messages no longer in storage", sub.Name(), missing)
+		}
+		bs, err := json.Marshal(struct {
+			NReplayed int `json:"n_replayed"`
+			NMissing  int `json:"n_missing"`
+		}{replayed, missing})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, ErrInternal, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write(bs)
+		w.Write([]byte("\n"))
+	}))
+
+	http.HandleFunc("/transfer", Authorize(PermAdmin, func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodPost) {
+			return
+		}
+		if !parseForm(w, r) {
+			return
+		}
+		var ends [2]*Subscription
+		for i, param := range []string{"from", "to"} {
+			name := r.Form.Get(param)
+			sub, ok := LookupSubscription(name)
+			if !ok {
+				writeError(w, http.StatusNotFound, ErrNotFound, fmt.Sprintf("no subscription %q", name))
+				return
+			}
+			ends[i] = sub
+		}
+		messageIDs := make([]uint64, 0, 16)
+		for _, idString := range r.Form["id"] {
+			id, err := strconv.ParseUint(idString, 10, 64)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, ErrInvalidID, fmt.Sprintf("invalid message id %q", idString))
+				return
+			}
+			messageIDs = append(messageIDs, id)
+		}
+		transferred, err := TransferMessages(ends[0], ends[1], messageIDs)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, ErrInvalidOption, err.Error())
+			return
+		}
+		bs, err := json.Marshal(struct {
+			NTransferred int `json:"n_transferred"`
+		}{transferred})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, ErrInternal, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write(bs)
+		w.Write([]byte("\n"))
+	}))
+
+	http.HandleFunc("/rename", Authorize(PermAdmin, func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodPost) {
+			return
+		}
+		if !parseForm(w, r) {
+			return
+		}
+		from, to := r.Form.Get("from"), r.Form.Get("to")
+		for _, name := range []string{from, to} {
+			if !validSubRegexp.MatchString(name) {
+				writeError(w, http.StatusBadRequest, ErrInvalidSub, fmt.Sprintf("invalid subscription name %q", name))
+				return
+			}
+		}
+		switch err := RenameSubscription(from, to); err {
+		case nil:
+			w.WriteHeader(http.StatusOK)
+		case errNoSub:
+			writeError(w, http.StatusNotFound, ErrNotFound, fmt.Sprintf("no subscription %q", from))
+		case errSubExists:
+			writeError(w, http.StatusConflict, ErrSubExists, fmt.Sprintf("subscription %q already exists", to))
+		default:
+			writeError(w, http.StatusInternalServerError, ErrStorage, "could not move the subscription's WAL")
+		}
+	}))
+
+	http.HandleFunc("/status", Authorize(PermPull, func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodGet, http.MethodHead) {
+			return
+		}
+		if !parseForm(w, r) {
+			return
+		}
+		sub, ok := GetSubscription(w, r, implicitCreate(false))
+		if !ok {
+			return
+		}
+		messageIDs := make([]uint64, 0, 16)
+		for _, idString := range r.Form["id"] {
+			id, err := strconv.ParseUint(idString, 10, 64)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, ErrInvalidID, fmt.Sprintf("invalid message id %q", idString))
+				return
+			}
+			messageIDs = append(messageIDs, id)
+		}
+		bs, err := json.Marshal(UnAckedStatus(sub, messageIDs))
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, ErrInternal, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write(bs)
+		w.Write([]byte("\n"))
+	}))
+
+	// Publishers may follow the Location header of their sends here.
+	http.HandleFunc("/message", Authorize(PermPublish, func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodGet, http.MethodHead) {
+			return
+		}
+		if !parseForm(w, r) {
+			return
+		}
+		idString := r.Form.Get("id")
+		id, err := strconv.ParseUint(idString, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, ErrInvalidID, fmt.Sprintf("invalid message id %q", idString))
+			return
+		}
+		info, err := InspectMessage(id)
+		if os.IsNotExist(err) {
+			writeError(w, http.StatusNotFound, ErrNotFound, fmt.Sprintf("no message with id %d", id))
+			return
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, ErrStorage, "could not stat message")
+			return
+		}
+		bs, err := json.Marshal(info)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, ErrInternal, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write(bs)
+		w.Write([]byte("\n"))
+	}))
+
+	http.HandleFunc("/orphans", Authorize(PermAdmin, func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodGet, http.MethodHead) {
+			return
+		}
+		if !parseForm(w, r) {
+			return
+		}
+		var from uint64
+		if s := r.Form.Get("from"); s != "" {
+			var err error
+			if from, err = strconv.ParseUint(s, 10, 64); err != nil {
+				writeError(w, http.StatusBadRequest, ErrInvalidID, fmt.Sprintf("invalid message id %q", s))
+				return
+			}
+		}
+		limit := 1000
+		if s := r.Form.Get("limit"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n <= 0 {
+				writeError(w, http.StatusBadRequest, ErrInvalidN, fmt.Sprintf("invalid limit %q", s))
+				return
+			}
+			limit = n
+		}
+		orphans, more, err := FindOrphans(from, limit)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, ErrStorage, "could not list messages")
+			return
+		}
+		resp := struct {
+			NOrphans int      `json:"n_orphans"`
+			Orphans  []uint64 `json:"orphans"`
+			NextFrom *uint64  `json:"next_from,omitempty"`
+		}{NOrphans: len(orphans), Orphans: orphans}
+		if more {
+			next := orphans[len(orphans)-1] + 1
+			resp.NextFrom = &next
+		}
+		bs, err := json.Marshal(resp)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, ErrInternal, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write(bs)
+		w.Write([]byte("\n"))
+	}))
+
+	// Debug only: the heap layout is an implementation detail and may change.
+	http.HandleFunc("/debug/heap", Authorize(PermAdmin, func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodGet, http.MethodHead) {
+			return
+		}
+		if !parseForm(w, r) {
+			return
+		}
+		name := r.Form.Get("sub")
+		sub, ok := LookupSubscription(name)
+		if !ok {
+			writeError(w, http.StatusNotFound, ErrNotFound, fmt.Sprintf("no subscription %q", name))
+			return
+		}
+		bs, err := json.Marshal(DumpHeap(sub))
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, ErrInternal, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write(bs)
+		w.Write([]byte("\n"))
+	}))
+
+	http.HandleFunc("/age-histogram", Authorize(PermPull, func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodGet, http.MethodHead) {
+			return
+		}
+		if !parseForm(w, r) {
+			return
+		}
+		sub, ok := GetSubscription(w, r, implicitCreate(false))
+		if !ok {
+			return
+		}
+		bounds := defaultAgeBuckets
+		if len(r.Form["bucket"]) > 0 {
+			bounds = make([]time.Duration, 0, len(r.Form["bucket"]))
+			for _, s := range r.Form["bucket"] {
+				d, err := time.ParseDuration(s)
+				if err != nil || d <= 0 || len(bounds) > 0 && d <= bounds[len(bounds)-1] {
+					writeError(w, http.StatusBadRequest, ErrInvalidOption, fmt.Sprintf("invalid bucket %q, want ascending positive durations", s))
+					return
+				}
+				bounds = append(bounds, d)
+			}
+		}
+		bs, err := json.Marshal(struct {
+			Sub     string      `json:"sub"`
+			Buckets []AgeBucket `json:"buckets"`
+		}{sub.Name(), AgeHistogram(sub, bounds, clock.Now())})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, ErrInternal, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write(bs)
+		w.Write([]byte("\n"))
+	}))
+
+	http.HandleFunc("/stats", Authorize(PermAdmin, func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodGet, http.MethodHead) {
+			return
+		}
+		stats := GetStats()
+		w.Header().Set("X-Backlog-Total", strconv.Itoa(stats.BacklogTotal))
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		bs, err := json.Marshal(stats)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, ErrInternal, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write(bs)
+		w.Write([]byte("\n"))
+	}))
+
+	http.HandleFunc("/subscriptions", Authorize(PermAdmin, func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodGet, http.MethodHead) {
+			return
+		}
+		list := ListSubscriptions()
+		w.Header().Set("X-Subscription-Count", strconv.Itoa(len(list)))
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		bs, err := json.Marshal(SubscriptionsResponse{len(list), list})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, ErrInternal, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write(bs)
+		w.Write([]byte("\n"))
+	}))
+
+	http.HandleFunc("/logs", Authorize(PermAdmin, ServeLogs))
+
+	http.HandleFunc("/tail", Authorize(PermPull, ServeTail))
+
+	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodGet, http.MethodHead) {
+			return
+		}
+		if r.URL.Query().Get("verbose") == "true" {
+			// The detail says more about the server than a load balancer needs to know.
+			Authorize(PermAdmin, serveHealthDetail)(w, r)
+			return
+		}
+		state := storageBreaker.State()
+		status := http.StatusOK
+		if state == BreakerOpen {
+			status = http.StatusServiceUnavailable
+		}
+		bs, err := json.Marshal(struct {
+			Healthy      bool   `json:"healthy"`
+			StorageState string `json:"storage_breaker"`
+		}{status == http.StatusOK, state})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, ErrInternal, err.Error())
+			return
+		}
+		w.WriteHeader(status)
+		w.Write(bs)
+		w.Write([]byte("\n"))
+	})
+
+	http.HandleFunc("/version", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodGet, http.MethodHead) {
+			return
+		}
+		bs, err := json.Marshal(struct {
+			Version   string `json:"version"`
+			Commit    string `json:"commit"`
+			GoVersion string `json:"go_version"`
+			BuildDate string `json:"build_date"`
+		}{version, commit, runtime.Version(), buildDate})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, ErrInternal, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write(bs)
+		w.Write([]byte("\n"))
+	})
+
+	if *signingKeyFilename != "" {
+		http.HandleFunc("/sign", Authorize(PermAdmin, func(w http.ResponseWriter, r *http.Request) {
+			if !allowMethods(w, r, http.MethodPost) {
+				return
+			}
+			if !parseForm(w, r) {
+				return
+			}
+			name := r.Form.Get("sub")
+			if !validSubRegexp.MatchString(name) {
+				writeError(w, http.StatusBadRequest, ErrInvalidSub, fmt.Sprintf("invalid subscription name %q", name))
+				return
+			}
+			ttlString := r.Form.Get("ttl")
+			ttl, err := time.ParseDuration(ttlString)
+			if err != nil || ttl <= 0 {
+				writeError(w, http.StatusBadRequest, ErrInvalidOption, fmt.Sprintf("invalid ttl %q", ttlString))
+				return
+			}
+			expires := clock.Now().Add(ttl)
+			// Keep the URL's ampersands readable rather than escaped as \u0026.
+			var buf bytes.Buffer
+			enc := json.NewEncoder(&buf)
+			enc.SetEscapeHTML(false)
+			err = enc.Encode(struct {
+				URL       string    `json:"url"`
+				ExpiresAt time.Time `json:"expires_at"`
+			}{SignPullURL(name, expires), expires})
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, ErrInternal, err.Error())
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			w.Write(buf.Bytes())
+		}))
+	}
+
+	if *allowMetricsReset {
+		http.HandleFunc("/metrics-reset", Authorize(PermAdmin, func(w http.ResponseWriter, r *http.Request) {
+			if !allowMethods(w, r, http.MethodPost) {
+				return
+			}
+			counters.Reset()
+			w.WriteHeader(http.StatusOK)
+		}))
+	}
+
 	addr := fmt.Sprintf("%s:%d", *host, *port)
+	server := &http.Server{
+		Addr:    addr,
+		Handler: LimitConcurrency(*maxConcurrent, http.DefaultServeMux),
+	}
+	configureKeepAlives(server)
+	if *clientCA != "" {
+		if *tlsCert == "" || *tlsKey == "" {
+			log.Fatalf("-client-ca requires -tls-cert and -tls-key")
+		}
+		pool, err := loadClientCAs(*clientCA)
+		if err != nil {
+			log.Fatalf("While loading client CA bundle: %v", err)
+		}
+		server.TLSConfig = &tls.Config{
+			ClientCAs:  pool,
+			ClientAuth: tls.RequireAndVerifyClientCert,
+		}
+	}
 	log.Printf("Storing data in %s", *dataDirname)
+	var listener net.Listener
+	if *unixSocket != "" {
+		if err := removeStaleSocket(*unixSocket); err != nil {
+			log.Fatalf("While removing stale socket: %v", err)
+		}
+		listener, err = net.Listen("unix", *unixSocket)
+		addr = *unixSocket
+	} else {
+		listener, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
 	log.Printf("Starting listener on %s", addr)
-	log.Fatal(http.ListenAndServe(addr, nil))
+
+	// Closing the server closes its listener, which also removes a Unix socket file.
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		<-stop
+		log.Printf("Shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("Forcing shutdown after %s with requests still in flight: %v", *shutdownTimeout, InFlightPaths())
+			server.Close()
+		}
+	}()
+
+	if *tlsCert != "" {
+		err = server.ServeTLS(listener, *tlsCert, *tlsKey)
+	} else {
+		err = server.Serve(listener)
+	}
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-drained
 }
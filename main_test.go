@@ -0,0 +1,321 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// setUp points the server at an empty temporary data directory and forgets every subscription, message id and receipt, undoing both when the test ends.
+func setUp(t testing.TB) {
+	dir, err := ioutil.TempDir("", "pubsubd-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldDir := *dataDirname
+	*dataDirname = dir
+	if err := os.MkdirAll(subsDirname(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	subsMu.Lock()
+	subs = make(map[string]*Subscription)
+	claims = make(map[string]*nameClaim)
+	subsMu.Unlock()
+	topic = &Topic{Name: "<default-topic>"}
+	nextIDMu.Lock()
+	nextIDMark = 0
+	nextIDMu.Unlock()
+	receiptsMu.Lock()
+	receipts = make(map[uint64]*receiptState)
+	receiptsMu.Unlock()
+	supersededMu.Lock()
+	superseded = make(map[uint64]bool)
+	supersededMu.Unlock()
+	bodyFormatsMu.Lock()
+	bodyFormats = make(map[uint64]*list.Element)
+	bodyFormatsLRU = list.New()
+	bodyFormatsMu.Unlock()
+	t.Cleanup(func() {
+		*dataDirname = oldDir
+		os.RemoveAll(dir)
+	})
+}
+
+// withWAL enables the WAL for the rest of the test.
+func withWAL(t testing.TB) {
+	*walEnabled = true
+	t.Cleanup(func() { *walEnabled = false })
+}
+
+func TestCreateSubscriptionConcurrently(t *testing.T) {
+	setUp(t)
+	withWAL(t)
+	const n = 50
+	got := make([]*Subscription, n)
+	created := make([]bool, n)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			sub, ok, err := createSubscription("racy", SubscriptionOptions{})
+			if err != nil {
+				t.Error(err)
+			}
+			got[i], created[i] = sub, ok
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	sub, ok := LookupSubscription("racy")
+	if !ok {
+		t.Fatal("subscription was not created")
+	}
+	nCreated := 0
+	for i := range got {
+		if got[i] != sub {
+			t.Errorf("call %d got %p, want the one subscription %p", i, got[i], sub)
+		}
+		if created[i] {
+			nCreated++
+		}
+	}
+	if nCreated != 1 {
+		t.Errorf("%d calls reported creating the subscription, want 1", nCreated)
+	}
+	if _, err := os.Stat(snapshotPath("racy")); err != nil {
+		t.Errorf("snapshot not written: %v", err)
+	}
+}
+
+func TestRenameOntoSubscriptionBeingCreated(t *testing.T) {
+	setUp(t)
+	withWAL(t)
+	for i := 0; i < 100; i++ {
+		from, to := fmt.Sprintf("from%d", i), fmt.Sprintf("to%d", i)
+		renamed, _, err := createSubscription(from, SubscriptionOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var wg sync.WaitGroup
+		var renameErr error
+		var fresh *Subscription
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			renameErr = RenameSubscription(from, to)
+		}()
+		go func() {
+			defer wg.Done()
+			fresh, _, _ = createSubscription(to, SubscriptionOptions{})
+		}()
+		wg.Wait()
+
+		atFrom, _ := LookupSubscription(from)
+		atTo, _ := LookupSubscription(to)
+		switch renameErr {
+		case nil:
+			if atTo != renamed || fresh != renamed || atFrom != nil {
+				t.Fatalf("after rename: %s=%p %s=%p, creation got %p; want the renamed %p at %s only", from, atFrom, to, atTo, fresh, renamed, to)
+			}
+		case errSubExists:
+			if atFrom != renamed || atTo != fresh || fresh == renamed {
+				t.Fatalf("after refused rename: %s=%p %s=%p, creation got %p; want %p left at %s", from, atFrom, to, atTo, fresh, renamed, from)
+			}
+		default:
+			t.Fatal(renameErr)
+		}
+	}
+}
+
+func TestEvictionRemovesOnlyVictimFiles(t *testing.T) {
+	setUp(t)
+	withWAL(t)
+	oldMax, oldEviction := *maxSubs, *subEviction
+	*maxSubs, *subEviction = 1, "lru"
+	defer func() { *maxSubs, *subEviction = oldMax, oldEviction }()
+
+	if _, err := CreateSubscription("old", SubscriptionOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CreateSubscription("new", SubscriptionOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := LookupSubscription("old"); ok {
+		t.Error("old subscription was not evicted")
+	}
+	if _, err := os.Stat(snapshotPath("old")); !os.IsNotExist(err) {
+		t.Errorf("evicted subscription's snapshot still there: %v", err)
+	}
+	if _, err := os.Stat(snapshotPath("new")); err != nil {
+		t.Errorf("new subscription's snapshot missing: %v", err)
+	}
+	subsMu.RLock()
+	defer subsMu.RUnlock()
+	if len(claims) != 0 {
+		t.Errorf("names still claimed: %v", claims)
+	}
+}
+
+// pushAll puts ids on sub's backlog as delivery would.
+func pushAll(sub *Subscription, ids ...uint64) {
+	defer sub.syncWAL()
+	sub.Lock()
+	defer sub.Unlock()
+	for _, id := range ids {
+		sub.push(id)
+	}
+}
+
+func TestRenameDuringAcksAndTransfers(t *testing.T) {
+	setUp(t)
+	a, _ := CreateSubscription("a", SubscriptionOptions{})
+	b, _ := CreateSubscription("b", SubscriptionOptions{})
+	for id := uint64(0); id < 200; id++ {
+		pushAll(a, id)
+	}
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			if err := RenameSubscription(a.Name(), fmt.Sprintf("a%d", i)); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for id := uint64(0); id < 100; id++ {
+			AckMessages([]uint64{id}, a)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for id := uint64(100); id < 200; id++ {
+			TransferMessages(a, b, []uint64{id})
+			CheckWatermarks(make(map[string]bool), clock.Now())
+		}
+	}()
+	wg.Wait()
+	if got := a.Stats().Backlog; got != 0 {
+		t.Errorf("renamed subscription has backlog %d, want 0", got)
+	}
+	if got := b.Stats().Backlog; got != 100 {
+		t.Errorf("transfer target has backlog %d, want 100", got)
+	}
+}
+
+func TestSendDuringRenameReachesSubscription(t *testing.T) {
+	setUp(t)
+	withWAL(t)
+	sub, _ := CreateSubscription("before", SubscriptionOptions{})
+	// Stall the rename while it moves the subscription's files.
+	sub.wal.syncMu.Lock()
+	renamed := make(chan error)
+	go func() { renamed <- RenameSubscription("before", "after") }()
+	for {
+		subsMu.RLock()
+		moving := claims["after"] != nil
+		subsMu.RUnlock()
+		if moving {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	baseID, recipients, _ := CreateMessageIds(1, Routing{RejectBacklog: -1})
+	sub.wal.syncMu.Unlock()
+	if err := <-renamed; err != nil {
+		t.Fatal(err)
+	}
+	if len(recipients) != 1 || recipients[0] != sub {
+		t.Errorf("a send during the rename went to %v, want the subscription being renamed", recipients)
+	}
+	releaseBatch(baseID, recipients, 1)
+	if got, ok := LookupSubscription("after"); !ok || got != sub {
+		t.Errorf("LookupSubscription(after) = %v, %v after the rename", got, ok)
+	}
+	if _, ok := LookupSubscription("before"); ok {
+		t.Error("the subscription is still found under its old name")
+	}
+}
+
+func TestAckWatchFollowsRename(t *testing.T) {
+	setUp(t)
+	sub, _ := CreateSubscription("before", SubscriptionOptions{})
+	watch := WatchAcks(7, 1, []*Subscription{sub})
+	pushAll(sub, 7)
+	if err := RenameSubscription("before", "after"); err != nil {
+		t.Fatal(err)
+	}
+	AckMessages([]uint64{7}, sub)
+	acked := watch.Wait(time.Second)
+	if !acked["after"] || len(acked) != 1 {
+		t.Errorf("Wait reported %v, want the ack under the new name", acked)
+	}
+}
+
+func TestAckWatchResolvedByDrops(t *testing.T) {
+	setUp(t)
+	dropping, _ := CreateSubscription("dropping", SubscriptionOptions{MaxBacklog: 1, BacklogPolicy: DropOldest})
+	moved, _ := CreateSubscription("moved", SubscriptionOptions{})
+	target, _ := CreateSubscription("target", SubscriptionOptions{})
+	recipients := []*Subscription{dropping, moved}
+	baseID, _, _ := CreateMessageIds(1, Routing{Targets: recipients, RejectBacklog: -1})
+	watch := WatchAcks(baseID, 1, recipients)
+	if err := PutMessages([]string{"first"}, nil, baseID, recipients); err != nil {
+		t.Fatal(err)
+	}
+	nextID, _, _ := CreateMessageIds(1, Routing{Targets: []*Subscription{dropping}, RejectBacklog: -1})
+	if err := PutMessages([]string{"second"}, nil, nextID, []*Subscription{dropping}); err != nil {
+		t.Fatal(err)
+	}
+	TransferMessages(moved, target, []uint64{baseID})
+
+	result := make(chan map[string]bool)
+	go func() { result <- watch.Wait(time.Minute) }()
+	select {
+	case acked := <-result:
+		if acked["dropping"] || acked["moved"] {
+			t.Errorf("Wait reported %v, want neither to have acked", acked)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Wait still waiting on subscriptions that dropped the message")
+	}
+}
+
+func TestPutBackAppliesTargetOptions(t *testing.T) {
+	setUp(t)
+	source, _ := CreateSubscription("source", SubscriptionOptions{})
+	small, _ := CreateSubscription("small", SubscriptionOptions{MaxMessageBytes: 4})
+	baseID, _, _ := CreateMessageIds(2, Routing{Targets: []*Subscription{source}, RejectBacklog: -1})
+	if err := PutMessages([]string{"tiny", "too big"}, nil, baseID, []*Subscription{source}); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := TransferMessages(source, small, []uint64{baseID, baseID + 1}); n != 1 || err != nil {
+		t.Errorf("TransferMessages = %d, %v, want only the small message moved", n, err)
+	}
+	if got := backlog(source); len(got) != 1 || got[0] != baseID+1 {
+		t.Errorf("source holds %v, want the big message left behind", got)
+	}
+
+	for _, opts := range []SubscriptionOptions{{Coalesce: true}, {MaxBacklog: 1}} {
+		bounded, _ := CreateSubscription(fmt.Sprintf("bounded%v", opts.Coalesce), opts)
+		if _, err := TransferMessages(source, bounded, []uint64{baseID + 1}); err != errBounded {
+			t.Errorf("TransferMessages to %+v returned %v, want errBounded", opts, err)
+		}
+		if _, _, err := ReplayMessages(bounded, time.Time{}, clock.Now().Add(time.Hour)); err != errBounded {
+			t.Errorf("ReplayMessages on %+v returned %v, want errBounded", opts, err)
+		}
+		if got := backlog(bounded); len(got) != 0 {
+			t.Errorf("%+v holds %v, want nothing put back", opts, got)
+		}
+	}
+}
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"container/list"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var compressStorage = flag.String("compress-storage", "", "Compress message files written from now on: \"gzip\", or \"\" to store bodies as sent")
+
+var reapInterval = flag.Duration("reap-interval", time.Second, "How often expired messages are removed from subscriptions and storage")
+
+// Storage format versions. A version 1 message is a bare body file with no metadata. From version 2 on, a ".meta" file sits next to the body file and records its version; metadata written before versions were recorded is version 2.
+const (
+	messageFormatV1      = 1
+	messageFormatV2      = 2
+	messageFormatCurrent = messageFormatV2
+)
+
+// MessageMeta is per-message metadata, stored next to the message body in a ".meta" file. Messages stored by older versions of pubsubd may have no such file.
+type MessageMeta struct {
+	Version    int        `json:"version,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	CRC32      *uint32    `json:"crc32,omitempty"`       // Checksum (IEEE) of the body; absent for messages stored before checksums were added.
+	ReceiptURL string     `json:"receipt_url,omitempty"` // Where to POST a receipt when the message is acked.
+	ToSubs     []string   `json:"to_subs,omitempty"`     // The only subscriptions the message is for; empty means all.
+	Selector   Labels     `json:"selector,omitempty"`    // Labels a subscription must carry for the message to be meant for it.
+	Encoding   string     `json:"encoding,omitempty"`    // How the message file is encoded: "" for the bare body, or "gzip".
+	Size       *int64     `json:"size,omitempty"`        // Body size before encoding; absent for bare bodies.
+}
+
+// RoutedTo reports whether the message is meant for subscription sub.
+func (meta MessageMeta) RoutedTo(sub *Subscription) bool {
+	return (len(meta.ToSubs) == 0 || Routed(meta.ToSubs, sub.Name())) && sub.Options.Labels.Match(meta.Selector)
+}
+
+// Routed reports whether sub is among the subscriptions named in routes.
+func Routed(routes []string, sub string) bool {
+	for _, name := range routes {
+		if name == sub {
+			return true
+		}
+	}
+	return false
+}
+
+// Labels are key=value pairs attached to a subscription, or, as a selector, required of one.
+type Labels map[string]string
+
+var validLabelRegexp = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+// ParseLabels parses comma-separated key=value pairs, as in "env=prod,tier=web". Keys and values may hold letters, digits, '_', '.' and '-'.
+func ParseLabels(s string) (Labels, error) {
+	labels := make(Labels)
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || !validLabelRegexp.MatchString(kv[0]) || !validLabelRegexp.MatchString(kv[1]) {
+			return nil, fmt.Errorf("invalid label %q, want key=value", pair)
+		}
+		labels[kv[0]] = kv[1]
+	}
+	return labels, nil
+}
+
+// Match reports whether labels carry every pair in selector. An empty selector matches anything.
+func (labels Labels) Match(selector Labels) bool {
+	for k, v := range selector {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// SelectSubscriptions returns those of targets, or of every subscription if targets is nil, whose labels match selector.
+func SelectSubscriptions(targets []*Subscription, selector Labels) []*Subscription {
+	if targets == nil {
+		subsMu.RLock()
+		targets = make([]*Subscription, 0, len(subs))
+		for _, sub := range subs {
+			targets = append(targets, sub)
+		}
+		subsMu.RUnlock()
+	}
+	selected := make([]*Subscription, 0, len(targets))
+	for _, sub := range targets {
+		if sub.Options.Labels.Match(selector) {
+			selected = append(selected, sub)
+		}
+	}
+	return selected
+}
+
+func metaPath(id uint64) string {
+	return messagePath(id) + ".meta"
+}
+
+// ParseMessageMeta reads the per-message metadata for a batch of n messages from a /send form. A parameter given once applies to every message; given n times, its values apply to the messages in order.
+func ParseMessageMeta(r *http.Request, n int, now time.Time) ([]MessageMeta, error) {
+	metas := make([]MessageMeta, n)
+	ttls := r.Form["ttl"]
+	if len(ttls) != 0 && len(ttls) != 1 && len(ttls) != n {
+		return nil, fmt.Errorf("got %d ttl values for %d messages", len(ttls), n)
+	}
+	for i := range metas {
+		if len(ttls) == 0 {
+			break
+		}
+		s := ttls[0]
+		if len(ttls) == n {
+			s = ttls[i]
+		}
+		ttl, err := time.ParseDuration(s)
+		if err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("invalid ttl %q", s)
+		}
+		expiresAt := now.Add(ttl)
+		metas[i].ExpiresAt = &expiresAt
+	}
+	receiptURLs := r.Form["receipt_url"]
+	if len(receiptURLs) != 0 && len(receiptURLs) != 1 && len(receiptURLs) != n {
+		return nil, fmt.Errorf("got %d receipt_url values for %d messages", len(receiptURLs), n)
+	}
+	for i := range metas {
+		if len(receiptURLs) == 0 {
+			break
+		}
+		s := receiptURLs[0]
+		if len(receiptURLs) == n {
+			s = receiptURLs[i]
+		}
+		if err := checkCallbackURL(s); err != nil {
+			return nil, fmt.Errorf("invalid receipt_url %q: %v", s, err)
+		}
+		metas[i].ReceiptURL = s
+	}
+	return metas, nil
+}
+
+func writeMessageMeta(id uint64, meta MessageMeta) error {
+	meta.Version = messageFormatCurrent
+	bs, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	if err := writeFileWithRetry(metaPath(id), bs); err != nil {
+		return err
+	}
+	setBodyFormat(id, meta)
+	return nil
+}
+
+// A bodyFormat is the part of a message's metadata needed to read its body. Keeping it in memory spares every read a second file read for the metadata.
+type bodyFormat struct {
+	version  int
+	encoding string
+	crc32    *uint32
+	size     *int64
+}
+
+// bodyFormatIndexSize is how many messages' body formats are kept in memory. The least recently used are forgotten first, and read from their metadata again when next needed.
+var bodyFormatIndexSize = 1 << 16
+
+type indexedFormat struct {
+	id     uint64
+	format bodyFormat
+}
+
+// bodyFormats indexes the body formats of the messages most recently written or read, most recent at the front of bodyFormatsLRU.
+var bodyFormats = make(map[uint64]*list.Element)
+var bodyFormatsLRU = list.New()
+var bodyFormatsMu = sync.Mutex{}
+
+func setBodyFormat(id uint64, meta MessageMeta) {
+	f := bodyFormat{meta.Version, meta.Encoding, meta.CRC32, meta.Size}
+	bodyFormatsMu.Lock()
+	defer bodyFormatsMu.Unlock()
+	if e, ok := bodyFormats[id]; ok {
+		e.Value.(*indexedFormat).format = f
+		bodyFormatsLRU.MoveToFront(e)
+		return
+	}
+	bodyFormats[id] = bodyFormatsLRU.PushFront(&indexedFormat{id, f})
+	for bodyFormatsLRU.Len() > bodyFormatIndexSize {
+		oldest := bodyFormatsLRU.Remove(bodyFormatsLRU.Back()).(*indexedFormat)
+		delete(bodyFormats, oldest.id)
+	}
+}
+
+func forgetBodyFormat(id uint64) {
+	bodyFormatsMu.Lock()
+	defer bodyFormatsMu.Unlock()
+	if e, ok := bodyFormats[id]; ok {
+		bodyFormatsLRU.Remove(e)
+		delete(bodyFormats, id)
+	}
+}
+
+// BodyFormat returns the body format of message id, reading its metadata only if it is not indexed. A message with no metadata is format version 1.
+func BodyFormat(id uint64) (bodyFormat, error) {
+	bodyFormatsMu.Lock()
+	e, ok := bodyFormats[id]
+	if ok {
+		bodyFormatsLRU.MoveToFront(e)
+		f := e.Value.(*indexedFormat).format
+		bodyFormatsMu.Unlock()
+		return f, nil
+	}
+	bodyFormatsMu.Unlock()
+	meta, err := ReadMessageMeta(id)
+	if os.IsNotExist(err) {
+		meta.Version = messageFormatV1
+	} else if err != nil {
+		return bodyFormat{}, err
+	}
+	setBodyFormat(id, meta)
+	return bodyFormat{meta.Version, meta.Encoding, meta.CRC32, meta.Size}, nil
+}
+
+// ReadMessageMeta reads the stored metadata of message id. It returns an error satisfying os.IsNotExist if the message has none.
+func ReadMessageMeta(id uint64) (MessageMeta, error) {
+	var meta MessageMeta
+	bs, err := ioutil.ReadFile(metaPath(id))
+	if err != nil {
+		return meta, err
+	}
+	if err := json.Unmarshal(bs, &meta); err != nil {
+		return meta, fmt.Errorf("parsing metadata of message %d: %v", id, err)
+	}
+	if meta.Version == 0 {
+		meta.Version = messageFormatV2
+	}
+	return meta, nil
+}
+
+// encodeBody encodes a message body for storage as -compress-storage asks, returning the bytes to write and the encoding used.
+func encodeBody(body []byte) ([]byte, string, error) {
+	if *compressStorage != "gzip" {
+		return body, "", nil
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(body); err != nil {
+		return nil, "", err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), "gzip", nil
+}
+
+// decodeMessage turns the contents of message id's file, in any supported format version, back into its body and checks the body against its stored checksum, counting any mismatch as corruption. Files of either encoding, and files with no metadata at all, can be read whatever -compress-storage says.
+func decodeMessage(id uint64, stored []byte) ([]byte, error) {
+	format, err := BodyFormat(id)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case format.version == messageFormatV1:
+		return stored, nil
+	case format.version > messageFormatCurrent:
+		return nil, fmt.Errorf("message %d has storage format version %d, newer than this pubsubd understands", id, format.version)
+	}
+	body := stored
+	switch format.encoding {
+	case "":
+	case "gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(stored))
+		if err == nil {
+			body, err = ioutil.ReadAll(zr)
+		}
+		if err != nil {
+			atomic.AddUint64(&counters.Corrupt, 1)
+			return nil, fmt.Errorf("message %d is corrupt: %v", id, err)
+		}
+	default:
+		return nil, fmt.Errorf("message %d has unknown encoding %q", id, format.encoding)
+	}
+	if format.crc32 != nil && crc32.ChecksumIEEE(body) != *format.crc32 {
+		atomic.AddUint64(&counters.Corrupt, 1)
+		return nil, fmt.Errorf("message %d is corrupt: checksum mismatch", id)
+	}
+	return body, nil
+}
+
+// storedBodySize returns the size of message id's body given the size of its file, which differ when the file is compressed.
+func storedBodySize(id uint64, fileSize int64) int64 {
+	format, err := BodyFormat(id)
+	if err != nil || format.size == nil {
+		return fileSize
+	}
+	return *format.size
+}
+
+// expiries indexes the expiry time of every stored message that has one.
+var expiries = make(map[uint64]time.Time)
+var expiriesMu = sync.RWMutex{}
+
+func setExpiry(id uint64, t time.Time) {
+	expiriesMu.Lock()
+	defer expiriesMu.Unlock()
+	expiries[id] = t
+}
+
+// Expiry returns the time message id expires, if it has a TTL.
+func Expiry(id uint64) (time.Time, bool) {
+	expiriesMu.RLock()
+	defer expiriesMu.RUnlock()
+	t, ok := expiries[id]
+	return t, ok
+}
+
+// IsExpired reports whether message id has outlived its TTL and must no longer be delivered.
+func IsExpired(id uint64, now time.Time) bool {
+	t, ok := Expiry(id)
+	return ok && !now.Before(t)
+}
+
+// LoadMessageMeta indexes the expiry and receipt URL of every stored message that has them. Metadata without a message file, left behind by a crash part way through a send, is removed. It is called once at startup.
+func LoadMessageMeta() error {
+	fis, err := ioutil.ReadDir(*dataDirname)
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		if !strings.HasSuffix(fi.Name(), ".meta") {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(fi.Name(), ".meta"), 10, 64)
+		if err != nil {
+			continue
+		}
+		if _, err := os.Stat(messagePath(id)); os.IsNotExist(err) {
+			if err := os.Remove(metaPath(id)); err != nil {
+				log.Printf("While removing metadata of unstored message %d: %v", id, err)
+			}
+			continue
+		}
+		meta, err := ReadMessageMeta(id)
+		if err != nil {
+			log.Printf("Ignoring unreadable metadata of message %d: %v", id, err)
+			continue
+		}
+		if meta.ExpiresAt != nil {
+			setExpiry(id, *meta.ExpiresAt)
+		}
+		if meta.ReceiptURL != "" {
+			setReceiptURL(id, meta.ReceiptURL, false)
+		}
+	}
+	return nil
+}
+
+// ReapExpiredMessages removes every message whose TTL has passed from all subscriptions and deletes it from storage. It returns the number of messages reaped.
+func ReapExpiredMessages(now time.Time) int {
+	expired := make(map[uint64]bool)
+	inFlight := InFlight()
+	expiriesMu.RLock()
+	for id, t := range expiries {
+		// A batch still being delivered could put an id back on a subscription after it was reaped, so its ids wait for the next run.
+		if !now.Before(t) && !inFlight(id) {
+			expired[id] = true
+		}
+	}
+	expiriesMu.RUnlock()
+	if len(expired) == 0 {
+		return 0
+	}
+
+	subsMu.RLock()
+	targets := make([]*Subscription, 0, len(subs))
+	for _, sub := range subs {
+		targets = append(targets, sub)
+	}
+	subsMu.RUnlock()
+	for _, sub := range targets {
+		sub.Lock()
+		released(sub, sub.removeMatching(func(id uint64) bool { return expired[id] }))
+		sub.Unlock()
+		sub.syncWAL()
+	}
+
+	// The expiries stay until the files are gone, so a pull that picked a message before it was reaped sees it expired and passes over it.
+	for id := range expired {
+		removeStoredMessage(id)
+	}
+	expiriesMu.Lock()
+	defer expiriesMu.Unlock()
+	for id := range expired {
+		delete(expiries, id)
+	}
+	return len(expired)
+}
+
+// removeStoredMessage deletes message id's files and forgets its cached body, body format and receipt URL.
+func removeStoredMessage(id uint64) {
+	messageCache.Remove(id)
+	for _, filename := range []string{messagePath(id), metaPath(id)} {
+		if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+			log.Printf("While removing message %d: %v", id, err)
+		}
+	}
+	forgetBodyFormat(id)
+	forgetReceiptURL(id)
+}
+
+// superseded holds the ids of messages a subscription let go of to make room for newer ones, replaced under coalesce or evicted by drop_oldest, until ReclaimSuperseded looks at them.
+var superseded = make(map[uint64]bool)
+var supersededMu = sync.Mutex{}
+
+func markSuperseded(ids []uint64) {
+	supersededMu.Lock()
+	defer supersededMu.Unlock()
+	for _, id := range ids {
+		superseded[id] = true
+	}
+}
+
+// reclaimMu keeps /replay and /transfer from pushing stored messages onto a backlog while ReclaimSuperseded finds the ones no subscription holds and deletes them. It is taken before subsMu and any subscription's lock.
+var reclaimMu = sync.RWMutex{}
+
+// ReclaimSuperseded deletes the stored superseded messages that no subscription holds and returns how many it deleted. Those some other subscription holds are kept like any message, and those of a batch still being delivered are looked at again next time.
+func ReclaimSuperseded() int {
+	supersededMu.Lock()
+	candidates := superseded
+	superseded = make(map[uint64]bool)
+	supersededMu.Unlock()
+	if len(candidates) == 0 {
+		return 0
+	}
+
+	inFlight := InFlight()
+	later := make([]uint64, 0)
+	for id := range candidates {
+		if inFlight(id) {
+			delete(candidates, id)
+			later = append(later, id)
+		}
+	}
+	markSuperseded(later)
+	reclaimMu.Lock()
+	defer reclaimMu.Unlock()
+	subsMu.RLock()
+	for _, sub := range subs {
+		sub.RLock()
+		for _, id := range sub.UnAcked {
+			delete(candidates, id)
+		}
+		sub.RUnlock()
+	}
+	subsMu.RUnlock()
+
+	for id := range candidates {
+		removeStoredMessage(id)
+	}
+	expiriesMu.Lock()
+	for id := range candidates {
+		delete(expiries, id)
+	}
+	expiriesMu.Unlock()
+	return len(candidates)
+}
+
+// StartReaper periodically reaps expired messages and reclaims superseded ones.
+func StartReaper(interval time.Duration) {
+	go func() {
+		for now := range clock.Tick(interval) {
+			atomic.StoreInt64(&lastReap, now.UnixNano())
+			if n := ReapExpiredMessages(now); n > 0 {
+				log.Printf("Reaped %d expired messages", n)
+			}
+			if n := ReclaimSuperseded(); n > 0 {
+				log.Printf("Reclaimed %d superseded messages", n)
+			}
+		}
+	}()
+}
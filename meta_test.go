@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCompressedMessageRoundTrip(t *testing.T) {
+	setUp(t)
+	*compressStorage = "gzip"
+	defer func() { *compressStorage = "" }()
+	if err := storeMessages([]string{"hello hello hello"}, nil, 1); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := ReadMessageMeta(1)
+	if err != nil || meta.Encoding != "gzip" {
+		t.Fatalf("got metadata %+v, %v; want gzip encoding", meta, err)
+	}
+	messages, err := GetMessages([]uint64{1})
+	if err != nil || messages[1] != "hello hello hello" {
+		t.Errorf("read back %q, %v", messages[1], err)
+	}
+}
+
+func TestLoadMessageMetaRemovesMetaWithoutBody(t *testing.T) {
+	setUp(t)
+	// A crash after the metadata was written but before the body.
+	if err := writeMessageMeta(3, MessageMeta{ReceiptURL: "http://example.com/"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadMessageMeta(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(metaPath(3)); !os.IsNotExist(err) {
+		t.Errorf("leftover metadata not removed: %v", err)
+	}
+	if _, ok := ReceiptURL(3); ok {
+		t.Error("leftover metadata was indexed")
+	}
+}
+
+func TestPullPassesOverReapedMessage(t *testing.T) {
+	setUp(t)
+	fake := useFakeClock(t)
+	sub, _ := CreateSubscription("reaped", SubscriptionOptions{})
+	if err := storeMessages([]string{"short-lived", "lasting"}, nil, 1); err != nil {
+		t.Fatal(err)
+	}
+	setExpiry(1, fake.Now().Add(time.Minute))
+	pushAll(sub, 1, 2)
+	ids := FindUnAckedMessageIds(sub, 10)
+	// The reaper runs between the pull picking ids and reading them.
+	fake.Advance(time.Minute)
+	ReapExpiredMessages(fake.Now())
+
+	messages, read, _, _, err := GetMessagesWithin(sub, ids, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(read, []uint64{2}) || messages[2] != "lasting" {
+		t.Errorf("read %v %q, want only message 2", read, messages)
+	}
+	metadata, err := GetPulledMetadata(sub, ids)
+	if err != nil || len(metadata) != 1 || metadata[0].ID != 2 {
+		t.Errorf("got metadata %+v, %v; want only message 2", metadata, err)
+	}
+}
+
+func TestReadsEveryFormatVersion(t *testing.T) {
+	setUp(t)
+	// Version 1: a bare body with no metadata.
+	if err := ioutil.WriteFile(messagePath(1), []byte("from v1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Version 2 as first written, before the version was recorded.
+	checksum := crc32.ChecksumIEEE([]byte("from v2"))
+	if err := ioutil.WriteFile(messagePath(2), []byte("from v2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(metaPath(2), []byte(fmt.Sprintf(`{"crc32":%d}`, checksum)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// A version from the future.
+	if err := ioutil.WriteFile(messagePath(3), []byte("from v9"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(metaPath(3), []byte(`{"version":9}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if meta, err := ReadMessageMeta(2); err != nil || meta.Version != messageFormatV2 {
+		t.Errorf("unversioned metadata read as %+v, %v; want version 2", meta, err)
+	}
+	messages, err := GetMessages([]uint64{1, 2})
+	if err != nil || messages[1] != "from v1" || messages[2] != "from v2" {
+		t.Errorf("read back %q, %v", messages, err)
+	}
+	if _, err := GetMessages([]uint64{3}); err == nil {
+		t.Error("read a message with a newer format version")
+	}
+}
+
+func TestReclaimSuperseded(t *testing.T) {
+	setUp(t)
+	latest, _ := CreateSubscription("latest", SubscriptionOptions{Coalesce: true})
+	for i := 0; i < 3; i++ {
+		baseID, recipients, _ := CreateMessageIds(1, Routing{RejectBacklog: -1})
+		if err := PutMessages([]string{fmt.Sprint("price ", i)}, nil, baseID, recipients); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			// A subscription created now holds the later messages but not the first.
+			CreateSubscription("everything", SubscriptionOptions{})
+		}
+	}
+	if n := ReclaimSuperseded(); n != 1 {
+		t.Errorf("reclaimed %d messages, want only the first", n)
+	}
+	if _, err := os.Stat(messagePath(0)); !os.IsNotExist(err) {
+		t.Errorf("superseded message held by nobody still stored: %v", err)
+	}
+	for _, id := range []uint64{1, 2} {
+		if _, err := os.Stat(messagePath(id)); err != nil {
+			t.Errorf("message %d, still held, was removed: %v", id, err)
+		}
+	}
+	if got := backlog(latest); !reflect.DeepEqual(got, []uint64{2}) {
+		t.Errorf("coalescing subscription holds %v, want only the newest", got)
+	}
+}
+
+func TestReclaimEvictedByDropOldest(t *testing.T) {
+	setUp(t)
+	CreateSubscription("tail", SubscriptionOptions{MaxBacklog: 1, BacklogPolicy: DropOldest})
+	for i := 0; i < 3; i++ {
+		baseID, recipients, _ := CreateMessageIds(1, Routing{RejectBacklog: -1})
+		if err := PutMessages([]string{fmt.Sprint("reading ", i)}, nil, baseID, recipients); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			// A subscription created now holds the second message until it is acked.
+			CreateSubscription("slow", SubscriptionOptions{})
+		}
+	}
+	if n := ReclaimSuperseded(); n != 1 {
+		t.Errorf("reclaimed %d messages, want only the first", n)
+	}
+	if _, err := os.Stat(messagePath(1)); err != nil {
+		t.Errorf("evicted message still held by another subscription was removed: %v", err)
+	}
+}
+
+func TestReclaimKeepsMessageBeingTransferred(t *testing.T) {
+	setUp(t)
+	a, _ := CreateSubscription("a", SubscriptionOptions{})
+	b, _ := CreateSubscription("b", SubscriptionOptions{})
+	baseID, recipients, _ := CreateMessageIds(1, Routing{Targets: []*Subscription{a}, RejectBacklog: -1})
+	if err := PutMessages([]string{"passed around"}, nil, baseID, recipients); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			TransferMessages(a, b, []uint64{baseID})
+			TransferMessages(b, a, []uint64{baseID})
+		}
+	}()
+	for transferring := true; transferring; {
+		select {
+		case <-done:
+			transferring = false
+		default:
+			markSuperseded([]uint64{baseID})
+			if n := ReclaimSuperseded(); n != 0 {
+				t.Fatal("reclaimed a message held throughout by one subscription or the other")
+			}
+		}
+	}
+	if _, err := getMessage(baseID); err != nil {
+		t.Errorf("message read back with %v", err)
+	}
+}
+
+func TestReadUsesIndexedFormat(t *testing.T) {
+	setUp(t)
+	*compressStorage = "gzip"
+	defer func() { *compressStorage = "" }()
+	if err := storeMessages([]string{"squeezed"}, nil, 1); err != nil {
+		t.Fatal(err)
+	}
+	// Were the metadata read from disk, the gzip body would be returned undecoded.
+	if err := os.Remove(metaPath(1)); err != nil {
+		t.Fatal(err)
+	}
+	messages, err := GetMessages([]uint64{1})
+	if err != nil || messages[1] != "squeezed" {
+		t.Errorf("read back %q, %v", messages[1], err)
+	}
+}
+
+func TestBodyFormatIndexIsBounded(t *testing.T) {
+	setUp(t)
+	old := bodyFormatIndexSize
+	bodyFormatIndexSize = 2
+	defer func() { bodyFormatIndexSize = old }()
+	if err := storeMessages([]string{"a", "b", "c"}, nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(bodyFormats) != 2 || bodyFormatsLRU.Len() != 2 {
+		t.Errorf("index holds %d formats, want 2", len(bodyFormats))
+	}
+	// The oldest was forgotten, and is read from its metadata again.
+	if messages, err := GetMessages([]uint64{0}); err != nil || messages[0] != "a" {
+		t.Errorf("read back %q, %v", messages[0], err)
+	}
+	removeStoredMessage(0)
+	if _, ok := bodyFormats[0]; ok || len(bodyFormats) != bodyFormatsLRU.Len() {
+		t.Error("format of a removed message kept in the index")
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// BenchmarkPull1000 measures reading, encoding and writing out a pull of 1000 100-byte messages.
+func BenchmarkPull1000(b *testing.B) {
+	setUp(b)
+	sub, _ := CreateSubscription("bulk", SubscriptionOptions{})
+	storeBacklog(b, sub, 1000, 100)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ids := FindUnAckedMessageIds(sub, 1000)
+		messages, read, missing, _, err := GetMessagesWithin(sub, ids, 0, false)
+		if err != nil || len(read) != 1000 {
+			b.Fatalf("read %d messages, %v", len(read), err)
+		}
+		bs, err := marshall(messages, missing)
+		if err != nil {
+			b.Fatal(err)
+		}
+		writeBody(httptest.NewRecorder(), bs)
+	}
+}
+
+// pullConcurrently has n goroutines pull up to 20 messages, within budget bytes, from sub at once, with the fake clock advanced by window once they have all joined one fetch. Each pull must get want messages.
+func pullConcurrently(t *testing.T, fake *fakeClock, sub *Subscription, n int, window time.Duration, budget, want int) {
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ids := FindUnAckedMessageIds(sub, 20)
+			if _, read, _, _, err := GetMessagesWithin(sub, ids, budget, false); err != nil || len(read) != want {
+				t.Errorf("read %d messages, want %d: %v", len(read), want, err)
+			}
+		}()
+	}
+	if window > 0 {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			sub.fetchMu.Lock()
+			joined := 0
+			if sub.fetching != nil {
+				joined = len(sub.fetching.wants)
+			}
+			sub.fetchMu.Unlock()
+			if joined == n {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%d of %d pulls joined the fetch", joined, n)
+			}
+			time.Sleep(time.Millisecond)
+		}
+		fake.Advance(window)
+	}
+	wg.Wait()
+}
+
+func TestPullCoalescing(t *testing.T) {
+	setUp(t)
+	fake := useFakeClock(t)
+	sub, _ := CreateSubscription("fanout", SubscriptionOptions{})
+	storeBacklog(t, sub, 20, 200*1024)
+	const pullers = 50
+
+	before := atomic.LoadUint64(&counters.DiskReads)
+	pullConcurrently(t, fake, sub, pullers, 0, 0, 20)
+	separate := atomic.LoadUint64(&counters.DiskReads) - before
+
+	old := *pullCoalesceWindow
+	*pullCoalesceWindow = 10 * time.Millisecond
+	defer func() { *pullCoalesceWindow = old }()
+	before = atomic.LoadUint64(&counters.DiskReads)
+	pullConcurrently(t, fake, sub, pullers, *pullCoalesceWindow, 0, 20)
+	coalesced := atomic.LoadUint64(&counters.DiskReads) - before
+
+	t.Logf("%d concurrent pulls of 20 messages: %d disk reads each reading alone, %d coalesced", pullers, separate, coalesced)
+	if coalesced != 20 {
+		t.Errorf("coalesced pulls did %d disk reads, want one per message", coalesced)
+	}
+}
+
+func TestStreamedPullMatchesBuffered(t *testing.T) {
+	setUp(t)
+	useFakeClock(t)
+	sub, _ := CreateSubscription("bulk", SubscriptionOptions{})
+	// Enough messages that ids sort differently as strings, and bodies that need escaping.
+	baseID, recipients, _ := CreateMessageIds(12, Routing{RejectBacklog: -1})
+	messages := make([]string, 12)
+	for i := range messages {
+		messages[i] = fmt.Sprintf("<message \"%d\">\n", i)
+	}
+	if err := PutMessages(messages, nil, baseID, recipients); err != nil {
+		t.Fatal(err)
+	}
+	ids := FindUnAckedMessageIds(sub, 12)
+	for _, array := range []bool{false, true} {
+		read, _, missing, _, err := GetMessagesWithin(sub, ids, 0, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var bs []byte
+		if array {
+			bs, err = marshallArray(ids, read, missing)
+		} else {
+			bs, err = marshall(read, missing)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		buffered, streamed := httptest.NewRecorder(), httptest.NewRecorder()
+		writeBody(buffered, bs)
+		if err := streamMessages(streamed, sub, ids, array); err != nil {
+			t.Fatal(err)
+		}
+		if buffered.Body.String() != streamed.Body.String() {
+			t.Errorf("array=%v: streamed\n%s\nbut buffered\n%s", array, streamed.Body, buffered.Body)
+		}
+	}
+}
+
+func TestCoalescedPullKeepsToBudget(t *testing.T) {
+	setUp(t)
+	fake := useFakeClock(t)
+	sub, _ := CreateSubscription("fanout", SubscriptionOptions{})
+	storeBacklog(t, sub, 20, 1024)
+	old := *pullCoalesceWindow
+	*pullCoalesceWindow = 10 * time.Millisecond
+	defer func() { *pullCoalesceWindow = old }()
+
+	// Each pull's budget fits two messages, so alone it would read three: two to return and the one that goes over.
+	before := atomic.LoadUint64(&counters.DiskReads)
+	pullConcurrently(t, fake, sub, 10, *pullCoalesceWindow, 2048, 2)
+	if reads := atomic.LoadUint64(&counters.DiskReads) - before; reads != 3 {
+		t.Errorf("coalesced pulls within a budget did %d disk reads, want 3", reads)
+	}
+}
+
+func TestReturnedTokensStayWithinBurst(t *testing.T) {
+	setUp(t)
+	sub, _ := CreateSubscription("limited", SubscriptionOptions{RateLimit: 2})
+	start := time.Unix(0, 0)
+	if got := sub.takeTokens(2, start); got != 2 {
+		t.Fatalf("first pull granted %d, want the full burst of 2", got)
+	}
+	later := start.Add(time.Second)
+	sub.takeTokens(1, later)
+	// The first pull found nothing, but the bucket has refilled meanwhile.
+	sub.returnTokens(2, 0, later)
+	if got := sub.limiter.tokens; got != 2 {
+		t.Errorf("bucket holds %v tokens, want no more than the burst of 2", got)
+	}
+}
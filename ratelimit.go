@@ -0,0 +1,82 @@
+package main
+
+import (
+	"flag"
+	"time"
+)
+
+var defaultRateLimit = flag.Float64("default-rate-limit", 0, "Messages per second a subscription without its own rate_limit may pull; 0 means no limit")
+
+// A rateLimiter is a token bucket limiting how many messages a subscription's pulls may return, plus a measure of the rate actually pulled. It is guarded by its subscription's lock.
+type rateLimiter struct {
+	tokens      float64
+	refilled    time.Time
+	windowStart time.Time
+	windowCount int
+	rate        float64 // Messages per second over the last full window.
+}
+
+// RateLimit returns the messages per second sub may pull, or 0 if unlimited.
+func (sub *Subscription) RateLimit() float64 {
+	if sub.Options.RateLimit > 0 {
+		return sub.Options.RateLimit
+	}
+	return *defaultRateLimit
+}
+
+// burst returns how many tokens sub's bucket holds when full: one second's worth, and at least one.
+func (sub *Subscription) burst() float64 {
+	if limit := sub.RateLimit(); limit > 1 {
+		return limit
+	}
+	return 1
+}
+
+// takeTokens returns how many of n wanted messages sub may pull now, and uses up that many tokens.
+func (sub *Subscription) takeTokens(n int, now time.Time) int {
+	sub.Lock()
+	defer sub.Unlock()
+	limit := sub.RateLimit()
+	if limit <= 0 {
+		return n
+	}
+	burst := sub.burst()
+	l := &sub.limiter
+	if l.refilled.IsZero() {
+		l.tokens = burst
+	} else if l.tokens += now.Sub(l.refilled).Seconds() * limit; l.tokens > burst {
+		l.tokens = burst
+	}
+	l.refilled = now
+	granted := n
+	if float64(granted) > l.tokens {
+		granted = int(l.tokens)
+	}
+	l.tokens -= float64(granted)
+	return granted
+}
+
+// returnTokens gives back tokens taken for messages that were not there to pull, and records how many were.
+func (sub *Subscription) returnTokens(unused, pulled int, now time.Time) {
+	sub.Lock()
+	defer sub.Unlock()
+	l := &sub.limiter
+	// Tokens refilled since they were taken may already have filled the bucket.
+	if l.tokens += float64(unused); l.tokens > sub.burst() {
+		l.tokens = sub.burst()
+	}
+	if elapsed := now.Sub(l.windowStart); elapsed >= time.Second {
+		l.rate = float64(l.windowCount) / elapsed.Seconds()
+		l.windowStart, l.windowCount = now, 0
+	}
+	l.windowCount += pulled
+}
+
+// pullRate returns the messages per second recently pulled from sub. The caller must hold sub's lock.
+func (sub *Subscription) pullRate(now time.Time) float64 {
+	l := &sub.limiter
+	if elapsed := now.Sub(l.windowStart); elapsed >= time.Second {
+		return float64(l.windowCount) / elapsed.Seconds()
+	}
+	return l.rate
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+var receiptMode = flag.String("receipt-mode", "each", "When a message's receipt_url is POSTed: on \"each\" subscription's ack, or once \"all\" subscriptions have acked it")
+var receiptWorkers = flag.Int("receipt-workers", 4, "Number of goroutines POSTing receipts")
+var receiptQueue = flag.Int("receipt-queue", 1000, "Number of receipts that may wait for a worker; receipts beyond it are dropped")
+
+// Receipt is the JSON payload POSTed to a message's receipt_url.
+type Receipt struct {
+	ID      uint64    `json:"id"`
+	Sub     string    `json:"sub"` // The subscription whose ack triggered the receipt.
+	AckedAt time.Time `json:"acked_at"`
+}
+
+// A receiptState tracks a message that wants receipts: where to send them, and how many subscriptions still hold it.
+type receiptState struct {
+	url     string
+	holders int
+	pending bool     // The message's batch is still being delivered, so more subscriptions may yet hold it.
+	acked   *Receipt // In "all" mode, the receipt owed once a pending delivery finishes with no holders.
+}
+
+// receipts indexes every stored message that has a receipt URL and may still be acked.
+var receipts = make(map[uint64]*receiptState)
+var receiptsMu = sync.Mutex{}
+
+// setReceiptURL records the receipt URL of message id. pending is true while the message's batch has yet to be delivered, until receiptsDelivered.
+func setReceiptURL(id uint64, url string, pending bool) {
+	receiptsMu.Lock()
+	defer receiptsMu.Unlock()
+	receipts[id] = &receiptState{url: url, pending: pending}
+}
+
+// forgetReceiptURL drops the receipt URL of message id and reports whether it had one.
+func forgetReceiptURL(id uint64) bool {
+	receiptsMu.Lock()
+	defer receiptsMu.Unlock()
+	_, ok := receipts[id]
+	delete(receipts, id)
+	return ok
+}
+
+// ReceiptURL returns the URL to notify when message id is acked, if it has one.
+func ReceiptURL(id uint64) (string, bool) {
+	receiptsMu.Lock()
+	defer receiptsMu.Unlock()
+	if rs, ok := receipts[id]; ok {
+		return rs.url, true
+	}
+	return "", false
+}
+
+// holdReceipt counts another subscription holding message id.
+func holdReceipt(id uint64) {
+	receiptsMu.Lock()
+	defer receiptsMu.Unlock()
+	if rs, ok := receipts[id]; ok {
+		rs.holders++
+		rs.acked = nil
+	}
+}
+
+// receiptsDelivered records that delivery of the batch of n messages at baseID is over, forgetting the receipt URLs of messages no subscription took, and sending any receipt held back for it.
+func receiptsDelivered(baseID uint64, n int) {
+	receiptsMu.Lock()
+	defer receiptsMu.Unlock()
+	for id := baseID; id < baseID+uint64(n); id++ {
+		rs, ok := receipts[id]
+		if !ok {
+			continue
+		}
+		rs.pending = false
+		if rs.holders == 0 {
+			delete(receipts, id)
+			if rs.acked != nil {
+				queueReceipt(rs.url, *rs.acked)
+			}
+		}
+	}
+}
+
+// SendReceipts queues a receipt for each of ids that sub has just acked and that asked for one. In "all" mode a receipt is only sent once no subscription holds the message, and then only once. A message's URL is forgotten once no subscription holds it.
+func SendReceipts(sub string, ids []uint64, now time.Time) {
+	receiptsMu.Lock()
+	defer receiptsMu.Unlock()
+	for _, id := range ids {
+		rs, ok := release(id)
+		if !ok {
+			continue
+		}
+		receipt := Receipt{id, sub, now}
+		if *receiptMode == "each" {
+			queueReceipt(rs.url, receipt)
+		} else if rs.holders == 0 {
+			if rs.pending {
+				rs.acked = &receipt
+			} else {
+				queueReceipt(rs.url, receipt)
+			}
+		}
+	}
+}
+
+// DropReceipts counts ids as no longer held by a subscription that did not ack them, as when they are dropped, coalesced away or moved elsewhere.
+func DropReceipts(ids []uint64) {
+	receiptsMu.Lock()
+	defer receiptsMu.Unlock()
+	for _, id := range ids {
+		release(id)
+	}
+}
+
+// release counts one fewer subscription holding message id, forgetting its receipt URL when none is left and its delivery is over. The caller must hold receiptsMu.
+func release(id uint64) (*receiptState, bool) {
+	rs, ok := receipts[id]
+	if !ok {
+		return nil, false
+	}
+	if rs.holders > 0 {
+		rs.holders--
+	}
+	if rs.holders == 0 && !rs.pending {
+		delete(receipts, id)
+	}
+	return rs, true
+}
+
+// RecountReceipts counts the subscriptions holding each message with a receipt URL, forgetting the URLs of messages none holds. It is called once at startup, after the subscriptions are loaded.
+func RecountReceipts() {
+	subsMu.RLock()
+	defer subsMu.RUnlock()
+	receiptsMu.Lock()
+	defer receiptsMu.Unlock()
+	for _, rs := range receipts {
+		rs.holders = 0
+	}
+	for _, sub := range subs {
+		sub.RLock()
+		for _, id := range sub.UnAcked {
+			if rs, ok := receipts[id]; ok {
+				rs.holders++
+			}
+		}
+		sub.RUnlock()
+	}
+	for id, rs := range receipts {
+		if rs.holders == 0 {
+			delete(receipts, id)
+		}
+	}
+}
+
+type queuedReceipt struct {
+	url     string
+	receipt Receipt
+}
+
+// receiptJobs feeds the receipt workers. It is nil until StartReceiptWorkers.
+var receiptJobs chan queuedReceipt
+
+// StartReceiptWorkers starts n goroutines POSTing receipts, fed by a queue of the given size.
+func StartReceiptWorkers(n, size int) {
+	receiptJobs = make(chan queuedReceipt, size)
+	for i := 0; i < n; i++ {
+		go func() {
+			for job := range receiptJobs {
+				what := fmt.Sprintf("receipt for message %d", job.receipt.ID)
+				if err := postJSON(job.url, job.receipt, what); err != nil {
+					log.Printf("Giving up on %s: %v", what, err)
+				}
+			}
+		}()
+	}
+}
+
+// queueReceipt hands a receipt to the workers, dropping it if they are too far behind.
+func queueReceipt(url string, receipt Receipt) {
+	select {
+	case receiptJobs <- queuedReceipt{url, receipt}:
+	default:
+		log.Printf("Dropping receipt for message %d: receipt queue is full", receipt.ID)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import "testing"
+
+// captureReceipts queues receipts on a channel the test reads instead of POSTing them.
+func captureReceipts(t *testing.T, mode string) chan queuedReceipt {
+	oldMode, oldJobs := *receiptMode, receiptJobs
+	*receiptMode = mode
+	receiptJobs = make(chan queuedReceipt, 100)
+	t.Cleanup(func() { *receiptMode, receiptJobs = oldMode, oldJobs })
+	return receiptJobs
+}
+
+// sendWithReceipt sends one message wanting a receipt to every subscription and returns its id.
+func sendWithReceipt(t *testing.T) uint64 {
+	baseID, recipients, _ := CreateMessageIds(1, Routing{RejectBacklog: -1})
+	if err := PutMessages([]string{"m"}, []MessageMeta{{ReceiptURL: "http://example.com/"}}, baseID, recipients); err != nil {
+		t.Fatal(err)
+	}
+	return baseID
+}
+
+func TestReceiptAllSentByLastAck(t *testing.T) {
+	setUp(t)
+	jobs := captureReceipts(t, "all")
+	a, _ := CreateSubscription("a", SubscriptionOptions{})
+	b, _ := CreateSubscription("b", SubscriptionOptions{})
+	id := sendWithReceipt(t)
+	AckMessages([]uint64{id}, a)
+	if len(jobs) != 0 {
+		t.Fatal("receipt sent while b still holds the message")
+	}
+	AckMessages([]uint64{id}, b)
+	if len(jobs) != 1 {
+		t.Fatalf("%d receipts queued after the last ack, want 1", len(jobs))
+	}
+	if job := <-jobs; job.receipt.Sub != "b" || job.receipt.ID != id {
+		t.Errorf("got receipt %+v, want b's ack of %d", job.receipt, id)
+	}
+	if _, ok := ReceiptURL(id); ok {
+		t.Error("receipt URL kept after the last ack")
+	}
+}
+
+func TestReceiptForgottenWhenDropped(t *testing.T) {
+	setUp(t)
+	jobs := captureReceipts(t, "each")
+	sub, _ := CreateSubscription("short", SubscriptionOptions{MaxBacklog: 1, BacklogPolicy: DropOldest})
+	first := sendWithReceipt(t)
+	sendWithReceipt(t)
+	if _, ok := ReceiptURL(first); ok {
+		t.Error("receipt URL of a dropped message kept")
+	}
+	AckMessages(FindUnAckedMessageIds(sub, 10), sub)
+	if len(jobs) != 1 {
+		t.Errorf("%d receipts queued, want 1 for the message acked", len(jobs))
+	}
+}
+
+func TestReceiptForgottenWithoutRecipients(t *testing.T) {
+	setUp(t)
+	captureReceipts(t, "all")
+	id := sendWithReceipt(t)
+	if _, ok := ReceiptURL(id); ok {
+		t.Error("receipt URL kept for a message no subscription received")
+	}
+}
+
+func TestRecountReceipts(t *testing.T) {
+	setUp(t)
+	captureReceipts(t, "all")
+	sub, _ := CreateSubscription("held", SubscriptionOptions{})
+	pushAll(sub, 1)
+	setReceiptURL(1, "http://example.com/", false)
+	setReceiptURL(2, "http://example.com/", false)
+	RecountReceipts()
+	if _, ok := ReceiptURL(2); ok {
+		t.Error("receipt URL of a message no subscription holds kept")
+	}
+	AckMessages([]uint64{1}, sub)
+	if len(receiptJobs) != 1 {
+		t.Errorf("%d receipts queued after the only holder acked, want 1", len(receiptJobs))
+	}
+}
+
+func TestReceiptForCoalescedMessage(t *testing.T) {
+	setUp(t)
+	jobs := captureReceipts(t, "all")
+	CreateSubscription("latest", SubscriptionOptions{Coalesce: true})
+	first := sendWithReceipt(t)
+	sendWithReceipt(t)
+	if len(jobs) != 1 {
+		t.Fatalf("%d receipts queued, want 1 for the message replaced", len(jobs))
+	}
+	if job := <-jobs; job.receipt.ID != first || job.receipt.Sub != "latest" {
+		t.Errorf("got receipt %+v, want latest's for message %d", job.receipt, first)
+	}
+}
+
+func TestCallbackURLMustBeAllowed(t *testing.T) {
+	old := *callbackAllow
+	defer func() { *callbackAllow = old }()
+	*callbackAllow = "https://hooks.example.com/receipts/, http://producer.internal"
+	for url, ok := range map[string]bool{
+		"https://hooks.example.com/receipts/17":    true,
+		"https://HOOKS.example.com/receipts/":      true,
+		"http://producer.internal/anything":        true,
+		"http://hooks.example.com/receipts/17":     false,
+		"https://hooks.example.com/admin":          false,
+		"https://hooks.example.com.evil/receipts/": false,
+		"http://169.254.169.254/latest/meta-data":  false,
+		"ftp://producer.internal/":                 false,
+	} {
+		if err := checkCallbackURL(url); (err == nil) != ok {
+			t.Errorf("checkCallbackURL(%q) = %v", url, err)
+		}
+	}
+	*callbackAllow = ""
+	if checkCallbackURL("https://hooks.example.com/receipts/17") == nil {
+		t.Error("callback URL allowed with no -callback-allow")
+	}
+	*callbackAllow = "*"
+	if err := checkCallbackURL("http://anywhere/"); err != nil {
+		t.Errorf("callback URL refused with -callback-allow '*': %v", err)
+	}
+}
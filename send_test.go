@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRejectBacklogUnderConcurrentSends(t *testing.T) {
+	setUp(t)
+	sub, _ := CreateSubscription("slow", SubscriptionOptions{})
+	const max = 10
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			baseID, recipients, backedUp := CreateMessageIds(1, Routing{RejectBacklog: max})
+			if backedUp != nil {
+				return
+			}
+			if err := PutMessages([]string{"m"}, nil, baseID, recipients); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := sub.Stats().Backlog; got > max+1 {
+		t.Errorf("backlog reached %d, want at most %d", got, max+1)
+	}
+}
+
+func TestFailedWriteLeavesNoPartialBatch(t *testing.T) {
+	setUp(t)
+	oldRetries := *writeRetries
+	*writeRetries = 0
+	defer func() { *writeRetries = oldRetries }()
+	sub, _ := CreateSubscription("all-or-nothing", SubscriptionOptions{})
+	const n, k = 5, 3
+	baseID, recipients, _ := CreateMessageIds(n, Routing{RejectBacklog: -1})
+	// A directory where the third message file belongs makes its write fail.
+	if err := os.Mkdir(messagePath(baseID+k-1), 0755); err != nil {
+		t.Fatal(err)
+	}
+	messages := []string{"one", "two", "three", "four", "five"}
+	if err := PutMessages(messages, nil, baseID, recipients); err == nil {
+		t.Fatal("PutMessages succeeded despite a failed write")
+	}
+	for i := uint64(0); i < n; i++ {
+		filenames := []string{metaPath(baseID + i)}
+		if i != k-1 {
+			filenames = append(filenames, messagePath(baseID+i))
+		}
+		for _, filename := range filenames {
+			if _, err := os.Stat(filename); !os.IsNotExist(err) {
+				t.Errorf("%s left behind: %v", filename, err)
+			}
+		}
+	}
+	if got := sub.Stats().Backlog; got != 0 {
+		t.Errorf("backlog %d after a failed send, want 0", got)
+	}
+	if got := atomic.LoadInt64(&sub.inbound); got != 0 {
+		t.Errorf("inbound %d after a failed send, want 0", got)
+	}
+}
+
+func TestCreateMessageIdsConcurrently(t *testing.T) {
+	setUp(t)
+	type batch struct {
+		base       uint64
+		n          int
+		recipients map[*Subscription]bool
+	}
+	const senders, sends = 20, 50
+	batches := make(chan batch, senders*sends)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			if _, err := CreateSubscription(fmt.Sprintf("sub%d", i), SubscriptionOptions{}); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < sends; j++ {
+				n := 1 + (i+j)%5
+				base, recipients, _ := CreateMessageIds(n, Routing{RejectBacklog: -1})
+				set := make(map[*Subscription]bool, len(recipients))
+				for _, sub := range recipients {
+					set[sub] = true
+				}
+				batches <- batch{base, n, set}
+				releaseBatch(base, recipients, n)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(batches)
+
+	var all []batch
+	for b := range batches {
+		all = append(all, b)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].base < all[j].base })
+	next := all[0].base
+	for i, b := range all {
+		if b.base != next {
+			t.Fatalf("batch %d starts at id %d, want %d: ids skipped or handed out twice", i, b.base, next)
+		}
+		next += uint64(b.n)
+		// Subscriptions are only added, so each batch goes to every recipient of the batch before it.
+		if i > 0 {
+			for sub := range all[i-1].recipients {
+				if !b.recipients[sub] {
+					t.Fatalf("%s received the batch at %d but not the later one at %d", sub.Name(), all[i-1].base, b.base)
+				}
+			}
+		}
+	}
+	if next != topic.NextMesgID {
+		t.Errorf("batches end at id %d, but the next id is %d", next, topic.NextMesgID)
+	}
+}
+
+func TestReaperWaitsForBatchInFlight(t *testing.T) {
+	setUp(t)
+	fake := useFakeClock(t)
+	sub, _ := CreateSubscription("late", SubscriptionOptions{})
+	baseID, recipients, _ := CreateMessageIds(1, Routing{RejectBacklog: -1})
+	if err := storeMessages([]string{"brief"}, nil, baseID); err != nil {
+		t.Fatal(err)
+	}
+	setExpiry(baseID, fake.Now().Add(time.Second))
+	// The message expires, and the reaper runs, before delivery gets to it.
+	fake.Advance(time.Second)
+	if n := ReapExpiredMessages(fake.Now()); n != 0 {
+		t.Errorf("reaped %d messages of a batch in flight", n)
+	}
+	DeliverMessages([]string{"brief"}, baseID, recipients)
+	if n := ReapExpiredMessages(fake.Now()); n != 1 {
+		t.Errorf("reaped %d messages once delivered, want 1", n)
+	}
+	if got := sub.Stats().Backlog; got != 0 {
+		t.Errorf("backlog %d holds a reaped message", got)
+	}
+}
+
+// BenchmarkSendTo10kSubscriptions measures the latency of a one-message send delivered to 10,000 subscriptions.
+func BenchmarkSendTo10kSubscriptions(b *testing.B) {
+	setUp(b)
+	for i := 0; i < 10000; i++ {
+		if _, err := CreateSubscription(fmt.Sprintf("sub%d", i), SubscriptionOptions{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		baseID, recipients, _ := CreateMessageIds(1, Routing{RejectBacklog: -1})
+		if err := PutMessages([]string{"hello"}, nil, baseID, recipients); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestOrphansExcludeBatchInFlight(t *testing.T) {
+	setUp(t)
+	baseID, recipients, _ := CreateMessageIds(1, Routing{RejectBacklog: -1})
+	if err := PutMessages([]string{"nobody listening"}, nil, baseID, recipients); err != nil {
+		t.Fatal(err)
+	}
+	sub, _ := CreateSubscription("slow", SubscriptionOptions{})
+	nextID, recipients, _ := CreateMessageIds(1, Routing{RejectBacklog: -1})
+	if err := storeMessages([]string{"on its way"}, nil, nextID); err != nil {
+		t.Fatal(err)
+	}
+	// The batch is stored but not yet delivered.
+	orphans, _, err := FindOrphans(0, 10)
+	if err != nil || !reflect.DeepEqual(orphans, []uint64{baseID}) {
+		t.Errorf("orphans %v, %v while the batch is in flight; want only %d", orphans, err, baseID)
+	}
+	DeliverMessages([]string{"on its way"}, nextID, recipients)
+	AckMessages([]uint64{nextID}, sub)
+	orphans, _, err = FindOrphans(0, 10)
+	if err != nil || !reflect.DeepEqual(orphans, []uint64{baseID, nextID}) {
+		t.Errorf("orphans %v, %v once delivered and acked; want %d and %d", orphans, err, baseID, nextID)
+	}
+}
+
+func TestBacklogNotificationsAreQueued(t *testing.T) {
+	setUp(t)
+	old := notifyJobs
+	notifyJobs = make(chan queuedNotification, 1)
+	defer func() { notifyJobs = old }()
+	for _, name := range []string{"first", "second"} {
+		CreateSubscription(name, SubscriptionOptions{NotifyURL: "http://consumer.internal/" + name})
+	}
+	// Both subscriptions go from empty to not, but only one notification fits in the queue.
+	baseID, recipients, _ := CreateMessageIds(1, Routing{RejectBacklog: -1})
+	if err := PutMessages([]string{"wake up"}, nil, baseID, recipients); err != nil {
+		t.Fatal(err)
+	}
+	if len(notifyJobs) != 1 {
+		t.Fatalf("%d notifications queued, want 1", len(notifyJobs))
+	}
+	if job := <-notifyJobs; job.notification.Backlog != 1 || job.url != "http://consumer.internal/"+job.notification.Sub {
+		t.Errorf("queued %+v for %s", job.notification, job.url)
+	}
+}
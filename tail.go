@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// tailBatch is the most messages /tail reads and acks at a time.
+const tailBatch = 100
+
+// tailRecheck bounds how long /tail waits between looks at an empty backlog, in case another tail of the same subscription took the arrival signal.
+const tailRecheck = time.Second
+
+// ServeTail streams a subscription's messages to the client as newline-delimited JSON as they arrive, acking each batch once it has been written, until the client disconnects. Delivery is at most once: a batch written just before a disconnect may be acked without having been received.
+func ServeTail(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	if !parseForm(w, r) {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, ErrInternal, "streaming is not supported on this connection")
+		return
+	}
+	sub, ok := GetSubscription(w, r, implicitCreate(true))
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		now := clock.Now()
+		n := sub.takeTokens(tailBatch, now)
+		ids := FindUnAckedMessageIds(sub, n)
+		sub.returnTokens(n-len(ids), len(ids), now)
+		if len(ids) == 0 {
+			recheck := clock.NewTimer(tailRecheck)
+			idle(r, func() {
+				select {
+				case <-r.Context().Done():
+				case <-sub.arrived:
+				case <-recheck.C():
+				}
+			})
+			recheck.Stop()
+			if r.Context().Err() != nil {
+				return
+			}
+			continue
+		}
+		messages, ids, _, _, err := GetMessagesWithin(sub, ids, 0, false)
+		if err != nil {
+			log.Printf("While tailing %s: %v", sub.Name(), err)
+			return
+		}
+		for _, id := range ids {
+			bs, err := json.Marshal(JSONMessage{id, messages[id], len(messages[id])})
+			if err != nil {
+				log.Printf("While tailing %s: %v", sub.Name(), err)
+				return
+			}
+			if _, err := w.Write(append(bs, '\n')); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+		if r.Context().Err() != nil {
+			return
+		}
+		NotifyPulled(ids)
+		AckMessages(ids, sub)
+	}
+}
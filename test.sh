@@ -6,9 +6,10 @@ cd $(dirname $0)
 
 set -e
 
-/bin/echo -n Checking for presence of curl and jq...
+/bin/echo -n Checking for presence of curl, jq and tar...
 which curl > /dev/null
 which jq > /dev/null
+which tar > /dev/null
 echo found
 
 data_dir=./data
@@ -62,7 +63,327 @@ else
     echo SUCCESS: Found one remaining message
 fi
 
+echo Verifying a transient send with a TTL is refused
+code=$(curl -X POST -d "message=fleeting&transient=true&ttl=1m" http://localhost:8080/send 2> /dev/null | jq -r .error.code)
+if [ "$code" != invalid_option ];
+then 
+    echo FAILURE: Expected invalid_option but got ${code}
+    exit_status=1
+else 
+    echo SUCCESS: Transient send with a TTL was refused
+fi
+
+echo Verifying a batch send answers with the ids of its messages
+ids=$(curl -X POST -d "message=eleven&message=twelve" http://localhost:8080/send 2> /dev/null | jq -c .ids)
+if [ "$ids" != "[11,12]" ];
+then 
+    echo FAILURE: Expected ids [11,12] but got ${ids}
+    exit_status=1
+else 
+    echo SUCCESS: Batch send returned its ids
+fi
+
+echo Creating subscription trimmed and sending it two messages
+curl "http://localhost:8080/pull?sub=trimmed&n=0" 2> /dev/null > /dev/null
+curl -X POST -d "message=old&message=older" http://localhost:8080/send 2> /dev/null > /dev/null
+
+echo Verifying a trim before the messages were sent leaves them, and one after discards them
+n_kept=$(curl -X POST "http://localhost:8080/trim?sub=trimmed&before=2000-01-01T00:00:00Z" 2> /dev/null | jq .n_trimmed)
+n_trimmed=$(curl -X POST "http://localhost:8080/trim?sub=trimmed&before=2999-01-01T00:00:00Z" 2> /dev/null | jq .n_trimmed)
+n_messages=$(curl "http://localhost:8080/pull?sub=trimmed&n=10" 2> /dev/null | jq .n_messages)
+if [ "$n_kept" != 0 ] || [ "$n_trimmed" != 2 ] || [ "$n_messages" != 0 ];
+then 
+    echo FAILURE: Expected to trim 0 then 2 messages leaving none, but trimmed ${n_kept} then ${n_trimmed} leaving ${n_messages}
+    exit_status=1
+else 
+    echo SUCCESS: Trim discarded only messages published before the given time
+fi
+
+echo Creating subscription replayed, sending it a message and acking it
+from=$(curl "http://localhost:8080/pull?sub=replayed&n=0" 2> /dev/null | jq -r .server_time)
+id=$(curl -X POST -d "message=again" http://localhost:8080/send 2> /dev/null | jq '.ids[0]')
+curl -X POST -d "sub=replayed&id=$id" http://localhost:8080/ack 2> /dev/null > /dev/null
+
+echo Verifying a replay from the subscription\'s creation puts the acked message back
+n_replayed=$(curl -X POST "http://localhost:8080/replay?sub=replayed&from=$from&to=2999-01-01T00:00:00Z" 2> /dev/null | jq .n_replayed)
+body=$(curl "http://localhost:8080/pull?sub=replayed&n=10" 2> /dev/null | jq -r '.messages[]')
+if [ "$n_replayed" != 1 ] || [ "$body" != again ];
+then 
+    echo FAILURE: Expected to replay 1 message and pull again, but replayed ${n_replayed} and pulled ${body}
+    exit_status=1
+else 
+    echo SUCCESS: Replay re-queued the acked message
+fi
+
+echo Creating subscriptions stuck and latest, sending a message, then creating healthy
+curl "http://localhost:8080/pull?sub=stuck&n=0" 2> /dev/null > /dev/null
+curl -X POST "http://localhost:8080/createsub?sub=latest&coalesce=true" 2> /dev/null > /dev/null
+id=$(curl -X POST -d "message=moving" http://localhost:8080/send 2> /dev/null | jq '.ids[0]')
+curl "http://localhost:8080/pull?sub=healthy&n=0" 2> /dev/null > /dev/null
+
+echo Verifying the message can be transferred from stuck to healthy but not onto a coalescing subscription
+code=$(curl -X POST "http://localhost:8080/transfer?from=stuck&to=latest&id=$id" 2> /dev/null | jq -r .error.code)
+n_transferred=$(curl -X POST "http://localhost:8080/transfer?from=stuck&to=healthy&id=$id" 2> /dev/null | jq .n_transferred)
+n_stuck=$(curl "http://localhost:8080/pull?sub=stuck&n=10" 2> /dev/null | jq .n_messages)
+n_healthy=$(curl "http://localhost:8080/pull?sub=healthy&n=10" 2> /dev/null | jq .n_messages)
+if [ "$code" != invalid_option ] || [ "$n_transferred" != 1 ] || [ "$n_stuck" != 0 ] || [ "$n_healthy" != 1 ];
+then 
+    echo FAILURE: Expected invalid_option, 1 transferred, and 0 and 1 messages left, but got ${code}, ${n_transferred}, ${n_stuck} and ${n_healthy}
+    exit_status=1
+else 
+    echo SUCCESS: Transfer moved the message between subscriptions
+fi
+
+echo Creating subscription deduped and sending it a batch with a repeated body
+curl "http://localhost:8080/pull?sub=deduped&n=0" 2> /dev/null > /dev/null
+same=$(curl -X POST -d "message=foo&message=bar&message=foo&dedup_batch=true" http://localhost:8080/send 2> /dev/null | jq '.ids[0] == .ids[2] and .ids[0] != .ids[1]')
+
+echo Verifying the repeated body was stored and delivered once
+n_messages=$(curl "http://localhost:8080/pull?sub=deduped&n=10" 2> /dev/null | jq .n_messages)
+if [ "$same" != true ] || [ "$n_messages" != 2 ];
+then 
+    echo FAILURE: Expected both foos to share an id and 2 messages delivered, but sharing was ${same} and ${n_messages} were delivered
+    exit_status=1
+else 
+    echo SUCCESS: Duplicate in the batch was collapsed
+fi
+
+echo Creating subscription tarred and sending it two messages
+curl "http://localhost:8080/pull?sub=tarred&n=0" 2> /dev/null > /dev/null
+curl -X POST -d "message=john&message=paul" http://localhost:8080/send 2> /dev/null > /dev/null
+
+echo Verifying a tar pull holds both bodies, in order
+bodies=$(curl -H "Accept: application/x-tar" "http://localhost:8080/pull?sub=tarred&n=10" 2> /dev/null | tar -xO 2> /dev/null)
+if [ "$bodies" != johnpaul ];
+then 
+    echo FAILURE: Expected the archive to hold johnpaul but got ${bodies}
+    exit_status=1
+else 
+    echo SUCCESS: Tar pull held both messages
+fi
+
+echo Creating subscription limited with a rate_limit of one message a second and sending it three messages
+curl -X POST "http://localhost:8080/createsub?sub=limited&rate_limit=1" 2> /dev/null > /dev/null
+curl -X POST -d "message=one&message=two&message=three" http://localhost:8080/send 2> /dev/null > /dev/null
+
+echo Verifying a pull gets one message and an immediate second pull is rate limited
+n_messages=$(curl "http://localhost:8080/pull?sub=limited&n=10" 2> /dev/null | jq .n_messages)
+code=$(curl "http://localhost:8080/pull?sub=limited&n=10" 2> /dev/null | jq -r .error.code)
+if [ "$n_messages" != 1 ] || [ "$code" != rate_limited ];
+then 
+    echo FAILURE: Expected 1 message then rate_limited, but got ${n_messages} then ${code}
+    exit_status=1
+else 
+    echo SUCCESS: Pulls were held to the rate limit
+fi
+
+echo Verifying checksub reports names without creating them
+checked=$(curl "http://localhost:8080/checksub?sub=unchecked" 2> /dev/null | jq -c .)
+twice=$(curl "http://localhost:8080/checksub?sub=unchecked" 2> /dev/null | jq -c .)
+existing=$(curl "http://localhost:8080/checksub?sub=sub0" 2> /dev/null | jq -c .)
+invalid=$(curl "http://localhost:8080/checksub?sub=no%20spaces" 2> /dev/null | jq .valid)
+if [ "$checked" != '{"valid":true,"exists":false}' ] || [ "$twice" != "$checked" ] || [ "$existing" != '{"valid":true,"exists":true}' ] || [ "$invalid" != false ];
+then 
+    echo FAILURE: Expected unchecked to stay free, sub0 to exist and no spaces to be invalid, but got ${checked}, ${twice}, ${existing} and ${invalid}
+    exit_status=1
+else 
+    echo SUCCESS: Checksub reported without creating
+fi
+
 echo Killing pubsubd
 kill $pid > /dev/null 2> /dev/null
+wait $pid 2> /dev/null || true
 rm -rf $data_dir
+
+./pubsubd --data-dir $data_dir --max-concurrent 2 --pull-error-mode skip&
+pid=$!
+echo Restarted pubsubd with --max-concurrent 2 and --pull-error-mode skip \(PID $pid\), waiting a second
+sleep 1
+
+echo Creating subscription waiters
+curl "http://localhost:8080/pull?sub=waiters&n=0" 2> /dev/null > /dev/null
+
+echo Sending two messages that wait for delivery, filling every concurrent request slot
+curl -X POST -d "message=first&wait_for_delivery=true&wait_timeout=10s" http://localhost:8080/send 2> /dev/null > $data_dir.waiter0 &
+waiter0=$!
+curl -X POST -d "message=second&wait_for_delivery=true&wait_timeout=10s" http://localhost:8080/send 2> /dev/null > $data_dir.waiter1 &
+waiter1=$!
+sleep 1
+
+echo Verifying a pull is still served while the senders wait
+n_messages=$(curl "http://localhost:8080/pull?sub=waiters&n=10" 2> /dev/null | jq .n_messages)
+wait $waiter0 $waiter1
+delivered=$(cat $data_dir.waiter0 $data_dir.waiter1 | jq -s '[.[].delivered[]] | all')
+if [ "$n_messages" != 2 ] || [ "$delivered" != true ];
+then 
+    echo FAILURE: Expected the pull to get 2 messages and both senders to see them delivered, but it got ${n_messages} and delivered was ${delivered}
+    exit_status=1
+else 
+    echo SUCCESS: Waiting senders were unblocked by the pull
+fi
+rm -f $data_dir.waiter0 $data_dir.waiter1
+
+echo Sending two messages that wait for every subscription to ack them, filling every concurrent request slot
+curl -X POST -d "message=third&wait_for_all=true&wait_timeout=10s" http://localhost:8080/send 2> /dev/null > $data_dir.waiter0 &
+waiter0=$!
+curl -X POST -d "message=fourth&wait_for_all=true&wait_timeout=10s" http://localhost:8080/send 2> /dev/null > $data_dir.waiter1 &
+waiter1=$!
+sleep 1
+
+echo Verifying a pull and an ack are still served while the senders wait
+ids=$(curl "http://localhost:8080/pull?sub=waiters&n=10" 2> /dev/null | jq -r '[(.messages // {}) | keys[] | "id=\(.)"] | join("&")')
+curl -X POST -d "sub=waiters&$ids" http://localhost:8080/ack 2> /dev/null > /dev/null
+wait $waiter0 $waiter1
+acked=$(cat $data_dir.waiter0 $data_dir.waiter1 | jq -s '[.[].acked.waiters] | all')
+if [ "$acked" != true ];
+then 
+    echo FAILURE: Expected both senders to see their message acked by waiters, but acked was ${acked}
+    exit_status=1
+else 
+    echo SUCCESS: Senders waiting for every ack were unblocked by the ack
+fi
+rm -f $data_dir.waiter0 $data_dir.waiter1
+
+echo Sending two messages and deleting the first one\'s file
+curl -X POST -d "message=lost&message=kept" http://localhost:8080/send 2> /dev/null > /dev/null
+rm $data_dir/4
+
+echo Verifying a tar pull names the unreadable message in X-Missing
+missing=$(curl -D - -o /dev/null -H "Accept: application/x-tar" "http://localhost:8080/pull?sub=waiters&n=10" 2> /dev/null | tr -d '\r' | sed -n 's/^X-Missing: //p')
+if [ "$missing" != 4 ];
+then 
+    echo FAILURE: Expected X-Missing: 4 but got ${missing}
+    exit_status=1
+else 
+    echo SUCCESS: Tar pull reported the missing message
+fi
+
+echo Opening two idle tails, filling every concurrent request slot
+curl -N "http://localhost:8080/tail?sub=tailers" 2> /dev/null > $data_dir.tail0 &
+tail0=$!
+curl -N "http://localhost:8080/tail?sub=tailers" 2> /dev/null > $data_dir.tail1 &
+tail1=$!
+sleep 1
+
+echo Verifying a send is still served while the tails wait, and reaches a tail
+code=$(curl -o /dev/null -w "%{http_code}" -X POST -d "message=tailed" http://localhost:8080/send 2> /dev/null)
+sleep 1
+kill $tail0 $tail1
+wait $tail0 $tail1 2> /dev/null || true
+tailed=$(cat $data_dir.tail0 $data_dir.tail1 | jq -r .body | sort -u)
+if [ "$code" != 201 ] || [ "$tailed" != tailed ];
+then 
+    echo FAILURE: Expected the send to get 201 and be tailed, but it got ${code} and the tails got ${tailed}
+    exit_status=1
+else 
+    echo SUCCESS: Idle tails left room for the send they were waiting for
+fi
+rm -f $data_dir.tail0 $data_dir.tail1
+
+echo Verifying the tailed message was acked
+n_messages=$(curl "http://localhost:8080/pull?sub=tailers&n=10" 2> /dev/null | jq .n_messages)
+if [ "$n_messages" != 0 ];
+then 
+    echo FAILURE: Expected no messages left on tailers but got ${n_messages}
+    exit_status=1
+else 
+    echo SUCCESS: Tailing acked the message
+fi
+
+echo Killing pubsubd
+kill $pid > /dev/null 2> /dev/null
+wait $pid 2> /dev/null || true
+rm -rf $data_dir
+
+./pubsubd --data-dir $data_dir --validate json&
+pid=$!
+echo Restarted pubsubd with --validate json \(PID $pid\), waiting a second
+sleep 1
+
+echo Creating subscription validated
+curl "http://localhost:8080/pull?sub=validated&n=0" 2> /dev/null > /dev/null
+
+echo Verifying a batch with a message that is not JSON is refused whole
+code=$(curl -X POST --data-urlencode 'message={"ok":true}' -d "message=plain" http://localhost:8080/send 2> /dev/null | jq -r .error.code)
+n_messages=$(curl "http://localhost:8080/pull?sub=validated&n=10" 2> /dev/null | jq .n_messages)
+if [ "$code" != invalid_message ] || [ "$n_messages" != 0 ];
+then 
+    echo FAILURE: Expected invalid_message and nothing delivered, but got ${code} and ${n_messages} messages
+    exit_status=1
+else 
+    echo SUCCESS: Batch with an invalid message was refused
+fi
+
+echo Verifying a JSON message is accepted
+code=$(curl -o /dev/null -w "%{http_code}" -X POST --data-urlencode 'message={"ok":true}' http://localhost:8080/send 2> /dev/null)
+if [ "$code" != 201 ];
+then 
+    echo FAILURE: Expected 201 but got ${code}
+    exit_status=1
+else 
+    echo SUCCESS: JSON message was accepted
+fi
+
+echo Killing pubsubd
+kill $pid > /dev/null 2> /dev/null
+wait $pid 2> /dev/null || true
+rm -rf $data_dir
+
+echo '{"publisher-token": {"publish": true}, "billing-token": {"pull": ["billing"]}, "ops-token": {"admin": true}}' > $data_dir.acl
+echo secret > $data_dir.key
+./pubsubd --data-dir $data_dir --acl $data_dir.acl --signing-key $data_dir.key&
+pid=$!
+echo Restarted pubsubd with --acl and --signing-key \(PID $pid\), waiting a second
+sleep 1
+
+echo Verifying a pull without a token is refused with 401
+code=$(curl -o /dev/null -w "%{http_code}" "http://localhost:8080/pull?sub=billing&n=0" 2> /dev/null)
+if [ "$code" != 401 ];
+then 
+    echo FAILURE: Expected 401 but got ${code}
+    exit_status=1
+else 
+    echo SUCCESS: Pull without a token was refused
+fi
+
+echo Verifying the publisher token may not pull, and the billing token may not send
+pull_code=$(curl -o /dev/null -w "%{http_code}" -H "Authorization: Bearer publisher-token" "http://localhost:8080/pull?sub=billing&n=0" 2> /dev/null)
+send_code=$(curl -o /dev/null -w "%{http_code}" -H "Authorization: Bearer billing-token" -X POST -d "message=bill" http://localhost:8080/send 2> /dev/null)
+if [ "$pull_code" != 403 ] || [ "$send_code" != 403 ];
+then 
+    echo FAILURE: Expected 403 for both but got ${pull_code} and ${send_code}
+    exit_status=1
+else 
+    echo SUCCESS: Tokens were held to their permissions
+fi
+
+echo Verifying a message sent with the publisher token reaches the billing token\'s pull
+curl -H "Authorization: Bearer billing-token" "http://localhost:8080/pull?sub=billing&n=0" 2> /dev/null > /dev/null
+curl -H "Authorization: Bearer publisher-token" -X POST -d "message=invoice" http://localhost:8080/send 2> /dev/null > /dev/null
+body=$(curl -H "Authorization: Bearer billing-token" "http://localhost:8080/pull?sub=billing&n=10" 2> /dev/null | jq -r '.messages[]')
+if [ "$body" != invoice ];
+then 
+    echo FAILURE: Expected to pull invoice but got ${body}
+    exit_status=1
+else 
+    echo SUCCESS: Billing token pulled what the publisher sent
+fi
+
+echo Minting a signed URL for billing
+url=$(curl -H "Authorization: Bearer ops-token" -X POST "http://localhost:8080/sign?sub=billing&ttl=1m" 2> /dev/null | jq -r .url)
+
+echo Verifying the signed URL pulls billing without a token, and is refused once altered
+code=$(curl -o /dev/null -w "%{http_code}" "http://localhost:8080$url&n=0" 2> /dev/null)
+altered_code=$(curl -o /dev/null -w "%{http_code}" "http://localhost:8080$(echo $url | sed 's/sub=billing/sub=other/')&n=0" 2> /dev/null)
+if [ "$code" != 200 ] || [ "$altered_code" != 403 ];
+then 
+    echo FAILURE: Expected 200 and 403 but got ${code} and ${altered_code}
+    exit_status=1
+else 
+    echo SUCCESS: Signed URL gave access to billing alone
+fi
+
+echo Killing pubsubd
+kill $pid > /dev/null 2> /dev/null
+rm -rf $data_dir $data_dir.acl $data_dir.key
 exit $exit_status
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"flag"
+)
+
+var transientRingSize = flag.Int("transient-ring", 1024, "How many transient messages each subscription holds before the oldest are dropped")
+
+// A TransientRing holds a subscription's transient messages in memory. When full, each new message overwrites the oldest.
+type TransientRing struct {
+	buf     []string
+	start   int
+	n       int
+	Dropped uint64 // Messages overwritten before they were pulled.
+}
+
+// NewTransientRing returns an empty ring holding up to size messages.
+func NewTransientRing(size int) *TransientRing {
+	return &TransientRing{buf: make([]string, size)}
+}
+
+// Push adds m, dropping the oldest message if the ring is full.
+func (ring *TransientRing) Push(m string) {
+	if len(ring.buf) == 0 {
+		ring.Dropped++
+		return
+	}
+	if ring.n == len(ring.buf) {
+		ring.start = (ring.start + 1) % len(ring.buf)
+		ring.n--
+		ring.Dropped++
+	}
+	ring.buf[(ring.start+ring.n)%len(ring.buf)] = m
+	ring.n++
+}
+
+// Drain removes and returns up to max of the oldest messages.
+func (ring *TransientRing) Drain(max int) []string {
+	if max > ring.n {
+		max = ring.n
+	}
+	messages := make([]string, max)
+	for i := range messages {
+		messages[i] = ring.buf[ring.start]
+		ring.buf[ring.start] = ""
+		ring.start = (ring.start + 1) % len(ring.buf)
+	}
+	ring.n -= max
+	return messages
+}
+
+// Len returns the number of messages waiting in the ring.
+func (ring *TransientRing) Len() int {
+	return ring.n
+}
+
+// DeliverTransient pushes messages onto the transient ring of every subscription in targets, or of every subscription if targets is nil, that accepts them. Nothing is stored.
+func DeliverTransient(messages []string, targets []*Subscription) {
+	if targets == nil {
+		subsMu.RLock()
+		targets = make([]*Subscription, 0, len(subs))
+		for _, sub := range subs {
+			targets = append(targets, sub)
+		}
+		subsMu.RUnlock()
+	}
+
+	for _, sub := range targets {
+		sub.Lock()
+		for _, m := range messages {
+			if !sub.Accepts(len(m)) {
+				sub.Skipped++
+				continue
+			}
+			if sub.transient == nil {
+				sub.transient = NewTransientRing(*transientRingSize)
+			}
+			sub.transient.Push(m)
+		}
+		sub.Unlock()
+	}
+}
+
+// PullTransient removes and returns up to max of sub's oldest transient messages. A paused subscription returns none.
+func PullTransient(sub *Subscription, max int) []string {
+	sub.Lock()
+	defer sub.Unlock()
+	if sub.Paused || sub.transient == nil {
+		return []string{}
+	}
+	return sub.transient.Drain(max)
+}
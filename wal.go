@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bytes"
+	"container/heap"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var walEnabled = flag.Bool("wal", false, "Persist subscription state in per-subscription write-ahead logs and recover it at startup")
+var walSnapshotEvery = flag.Int("wal-snapshot-every", 10000, "Number of logged pushes and acks after which a subscription's WAL is compacted into a snapshot")
+
+// A subscriptionWAL is the write-ahead log of one subscription. Each record is a line holding '+' (pushed) or '-' (acked) and a message id, ended by a newline; a final line without one was torn by a crash and is ignored. The log only holds changes made since the subscription's last snapshot.
+//
+// Records are committed in groups. Changes made under the subscription's lock only append records to an in-memory buffer; whoever made them then calls syncWAL once the lock is released, which writes and fsyncs everything buffered so far, or writes a snapshot when one is due. A change is therefore durable when the call that made it returns, concurrent changes share an fsync, and no file I/O happens while the subscription is locked.
+type subscriptionWAL struct {
+	syncMu sync.Mutex // Held while the files are written. It is taken before the subscription's lock, never while holding it.
+	f      *os.File   // Guarded by syncMu.
+
+	mu          sync.Mutex // Guards the fields below.
+	buf         []byte     // Records not yet written to f.
+	records     int        // Records logged since the last snapshot.
+	snapshotDue bool
+	closed      bool // The subscription was destroyed; nothing more is logged.
+}
+
+// subscriptionSnapshot is the on-disk form of a subscription's state at the time its WAL was last compacted.
+type subscriptionSnapshot struct {
+	Name      string              `json:"name"`
+	Options   SubscriptionOptions `json:"options"`
+	Paused    bool                `json:"paused"`
+	CreatedAt time.Time           `json:"created_at"`
+	Cursor    uint64              `json:"cursor"`
+	UnAcked   []uint64            `json:"unacked"`
+}
+
+func subsDirname() string {
+	return filepath.Join(*dataDirname, "subs")
+}
+
+func snapshotPath(name string) string {
+	return filepath.Join(subsDirname(), name+".snap")
+}
+
+func walPath(name string) string {
+	return filepath.Join(subsDirname(), name+".wal")
+}
+
+// logRecord buffers a WAL record. The caller must hold sub's write lock and call syncWAL after releasing it.
+func (sub *Subscription) logRecord(op byte, id uint64) {
+	w := sub.wal
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return
+	}
+	w.buf = append(w.buf, op)
+	w.buf = strconv.AppendUint(w.buf, id, 10)
+	w.buf = append(w.buf, '\n')
+	w.records++
+}
+
+// compactWAL marks a snapshot as due once the subscription's WAL has grown past -wal-snapshot-every records. The caller must hold sub's write lock and call syncWAL after releasing it.
+func (sub *Subscription) compactWAL() {
+	if sub.wal == nil {
+		return
+	}
+	sub.wal.mu.Lock()
+	defer sub.wal.mu.Unlock()
+	if sub.wal.records >= *walSnapshotEvery {
+		sub.wal.snapshotDue = true
+	}
+}
+
+// snapshotLater marks a snapshot as due, for a change to state the WAL does not record. The caller must hold sub's write lock and call syncWAL after releasing it.
+func (sub *Subscription) snapshotLater() {
+	if sub.wal == nil {
+		return
+	}
+	sub.wal.mu.Lock()
+	defer sub.wal.mu.Unlock()
+	sub.wal.snapshotDue = true
+}
+
+// syncWAL makes every change logged so far durable, by writing a snapshot if one is due and otherwise by writing and fsyncing the buffered records. The caller must not hold sub's lock.
+func (sub *Subscription) syncWAL() {
+	w := sub.wal
+	if w == nil {
+		return
+	}
+	w.syncMu.Lock()
+	defer w.syncMu.Unlock()
+	w.mu.Lock()
+	closed, due := w.closed, w.snapshotDue || w.f == nil
+	w.mu.Unlock()
+	if closed {
+		return
+	}
+	if due {
+		err := sub.writeSnapshot()
+		if err != nil {
+			log.Printf("While snapshotting %s: %v", sub.Name(), err)
+		}
+		walResult(err)
+	}
+	w.mu.Lock()
+	buf := w.buf
+	w.buf = nil
+	w.mu.Unlock()
+	if len(buf) == 0 || w.f == nil {
+		return
+	}
+	_, err := w.f.Write(buf)
+	if err == nil {
+		err = w.f.Sync()
+	}
+	if err != nil {
+		log.Printf("While logging to WAL of %s: %v", sub.Name(), err)
+	}
+	walResult(err)
+}
+
+// writeSnapshot writes the subscription's complete state and starts a new, empty WAL. Records logged while the snapshot is written stay buffered for the next sync. The caller must hold sub.wal.syncMu but not sub's lock. Replaying an old WAL over a newer snapshot at worst redelivers a message acked in between, so a crash between the two steps loses nothing.
+func (sub *Subscription) writeSnapshot() error {
+	w := sub.wal
+	sub.RLock()
+	name := sub.Name()
+	snap := subscriptionSnapshot{
+		Name:      name,
+		Options:   sub.Options,
+		Paused:    sub.Paused,
+		CreatedAt: sub.CreatedAt,
+		Cursor:    sub.Cursor,
+		UnAcked:   append([]uint64{}, sub.UnAcked...),
+	}
+	// Everything buffered so far is reflected in snap.
+	w.mu.Lock()
+	covered := len(w.buf)
+	w.snapshotDue = false
+	w.mu.Unlock()
+	sub.RUnlock()
+
+	err := writeSnapshotFile(name, snap)
+	var f *os.File
+	if err == nil {
+		f, err = os.OpenFile(walPath(name), os.O_WRONLY|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0644)
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err != nil {
+		w.snapshotDue = true
+		return err
+	}
+	if w.f != nil {
+		w.f.Close()
+	}
+	w.f = f
+	w.buf = append([]byte{}, w.buf[covered:]...)
+	w.records = 0
+	return nil
+}
+
+// writeSnapshotFile durably replaces the snapshot of subscription name with snap.
+func writeSnapshotFile(name string, snap subscriptionSnapshot) error {
+	bs, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	tmp := snapshotPath(name) + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(bs)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, snapshotPath(name))
+}
+
+// startWAL gives a subscription that no other goroutine can see yet its WAL, starting with a snapshot.
+func (sub *Subscription) startWAL() error {
+	sub.wal = &subscriptionWAL{}
+	sub.wal.syncMu.Lock()
+	defer sub.wal.syncMu.Unlock()
+	return sub.writeSnapshot()
+}
+
+// persist starts logging a newly created subscription if the WAL is enabled. It must be called before the subscription is added to subs.
+func (sub *Subscription) persist() {
+	if !*walEnabled {
+		return
+	}
+	err := sub.startWAL()
+	if err != nil {
+		log.Printf("While creating WAL for %s: %v", sub.Name(), err)
+	}
+	walResult(err)
+}
+
+// unpersist stops logging a destroyed subscription and deletes its snapshot and WAL.
+func (sub *Subscription) unpersist() {
+	w := sub.wal
+	if w == nil {
+		return
+	}
+	w.syncMu.Lock()
+	defer w.syncMu.Unlock()
+	w.mu.Lock()
+	w.closed = true
+	w.buf = nil
+	w.mu.Unlock()
+	if w.f != nil {
+		w.f.Close()
+		w.f = nil
+	}
+	removeWALFiles(sub.Name())
+}
+
+func removeWALFiles(name string) {
+	for _, filename := range []string{snapshotPath(name), walPath(name)} {
+		if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+			log.Printf("While removing %s: %v", filename, err)
+		}
+	}
+}
+
+// rename changes the subscription's name from from to to, moving its snapshot and WAL. The new files are written before the old ones are removed, so a crash part way recovers the subscription under both names rather than neither. If the new files cannot be written the name is left as it was. The caller must not hold sub's lock.
+func (sub *Subscription) rename(from, to string) error {
+	w := sub.wal
+	if w != nil {
+		w.syncMu.Lock()
+		defer w.syncMu.Unlock()
+	}
+	sub.Lock()
+	sub.name.Store(to)
+	sub.Unlock()
+	if w == nil {
+		return nil
+	}
+	if err := sub.writeSnapshot(); err != nil {
+		sub.Lock()
+		sub.name.Store(from)
+		sub.Unlock()
+		return err
+	}
+	removeWALFiles(from)
+	return nil
+}
+
+// loadSubscription rebuilds a subscription from its snapshot and the tail of its WAL.
+func loadSubscription(name string) (*Subscription, error) {
+	bs, err := ioutil.ReadFile(snapshotPath(name))
+	if err != nil {
+		return nil, err
+	}
+	var snap subscriptionSnapshot
+	if err := json.Unmarshal(bs, &snap); err != nil {
+		return nil, fmt.Errorf("parsing snapshot of %s: %v", name, err)
+	}
+	unacked := make(map[uint64]bool, len(snap.UnAcked))
+	for _, id := range snap.UnAcked {
+		unacked[id] = true
+	}
+
+	records, err := ioutil.ReadFile(walPath(name))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	lines := bytes.Split(records, []byte("\n"))
+	if torn := lines[len(lines)-1]; len(torn) > 0 {
+		log.Printf("Ignoring torn final WAL record %q of %s", torn, name)
+	}
+	for _, line := range lines[:len(lines)-1] {
+		if len(line) < 2 || line[0] != '+' && line[0] != '-' {
+			continue
+		}
+		id, err := strconv.ParseUint(string(line[1:]), 10, 64)
+		if err != nil {
+			continue
+		}
+		unacked[id] = line[0] == '+'
+	}
+
+	sub := newSubscription(name, snap.Options)
+	sub.Paused = snap.Paused
+	if !snap.CreatedAt.IsZero() {
+		sub.CreatedAt = snap.CreatedAt
+	}
+	sub.Cursor = snap.Cursor
+	removed := make([]uint64, 0)
+	for id, ok := range unacked {
+		if ok {
+			sub.UnAcked = append(sub.UnAcked, id)
+		} else {
+			removed = append(removed, id)
+		}
+	}
+	heap.Init(&sub.UnAcked)
+	sub.moveCursor(removed...)
+	return sub, nil
+}
+
+// LoadSubscriptions recovers every persisted subscription, compacting each WAL into a fresh snapshot. It creates the subscriptions directory if needed.
+func LoadSubscriptions() error {
+	if err := os.MkdirAll(subsDirname(), 0755); err != nil {
+		return err
+	}
+	start := clock.Now()
+	fis, err := ioutil.ReadDir(subsDirname())
+	if err != nil {
+		return err
+	}
+	loaded := make(map[string]*Subscription)
+	nMessage := 0
+	for _, fi := range fis {
+		if !strings.HasSuffix(fi.Name(), ".snap") {
+			continue
+		}
+		name := strings.TrimSuffix(fi.Name(), ".snap")
+		sub, err := loadSubscription(name)
+		if err != nil {
+			return err
+		}
+		if err := sub.startWAL(); err != nil {
+			return err
+		}
+		loaded[name] = sub
+		nMessage += len(sub.UnAcked)
+	}
+	subsMu.Lock()
+	for name, sub := range loaded {
+		subs[name] = sub
+	}
+	subsMu.Unlock()
+	log.Printf("Recovered %d subscriptions holding %d unacked messages in %v", len(loaded), nMessage, clock.Now().Sub(start))
+	return nil
+}
+
+// nextIDPath is the file holding a high-water mark of the message ids handed out, kept because the files of the newest messages may since have been reaped or reclaimed.
+func nextIDPath() string {
+	return filepath.Join(*dataDirname, "next_id")
+}
+
+// nextIDMark is the next message id last written to nextIDPath. nextIDMu guards it and serializes writes of the file.
+var nextIDMark uint64
+var nextIDMu = sync.Mutex{}
+
+// recordNextID writes next to nextIDPath before messages with ids below it are stored, unless a mark at least as high has been written already.
+func recordNextID(next uint64) error {
+	nextIDMu.Lock()
+	defer nextIDMu.Unlock()
+	if next <= nextIDMark {
+		return nil
+	}
+	tmp := nextIDPath() + ".tmp"
+	if err := writeFileWithRetry(tmp, []byte(strconv.FormatUint(next, 10))); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, nextIDPath()); err != nil {
+		return err
+	}
+	nextIDMark = next
+	return nil
+}
+
+// RecoverNextMessageID sets the topic's next message id past every message file already in the data directory and past the recorded high-water mark, so a restart never reuses an id.
+func RecoverNextMessageID() error {
+	stored, err := listStoredMessages()
+	if err != nil {
+		return err
+	}
+	var mark uint64
+	bs, err := ioutil.ReadFile(nextIDPath())
+	if err == nil {
+		if mark, err = strconv.ParseUint(string(bytes.TrimSpace(bs)), 10, 64); err != nil {
+			log.Printf("Ignoring unreadable %s: %v", nextIDPath(), err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	topic.Lock()
+	defer topic.Unlock()
+	if len(stored) > 0 && stored[len(stored)-1].ID >= topic.NextMesgID {
+		topic.NextMesgID = stored[len(stored)-1].ID + 1
+	}
+	if mark > topic.NextMesgID {
+		topic.NextMesgID = mark
+	}
+	nextIDMu.Lock()
+	defer nextIDMu.Unlock()
+	nextIDMark = mark
+	return nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// backlog returns sub's unacked ids in ascending order.
+func backlog(sub *Subscription) []uint64 {
+	sub.RLock()
+	defer sub.RUnlock()
+	ids := append([]uint64{}, sub.UnAcked...)
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func TestWALRecoversBacklog(t *testing.T) {
+	setUp(t)
+	withWAL(t)
+	sub, _ := CreateSubscription("durable", SubscriptionOptions{})
+	pushAll(sub, 1, 2, 3, 4, 5)
+	AckMessages([]uint64{2, 4}, sub)
+	SetPaused(sub, true)
+
+	loaded, err := loadSubscription("durable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := backlog(loaded), []uint64{1, 3, 5}; !reflect.DeepEqual(got, want) {
+		t.Errorf("recovered backlog %v, want %v", got, want)
+	}
+	if !loaded.Paused || loaded.Cursor != 1 {
+		t.Errorf("recovered paused=%v cursor=%d, want paused at cursor 1", loaded.Paused, loaded.Cursor)
+	}
+}
+
+func TestWALIgnoresTornRecord(t *testing.T) {
+	setUp(t)
+	if err := writeSnapshotFile("torn", subscriptionSnapshot{Name: "torn", UnAcked: []uint64{1}}); err != nil {
+		t.Fatal(err)
+	}
+	// The crash cut "+123\n" short.
+	if err := ioutil.WriteFile(walPath("torn"), []byte("+2\n-1\n+12"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sub, err := loadSubscription("torn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := backlog(sub), []uint64{2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("recovered backlog %v, want %v", got, want)
+	}
+}
+
+func TestWALSnapshotsOutsideLock(t *testing.T) {
+	setUp(t)
+	withWAL(t)
+	old := *walSnapshotEvery
+	*walSnapshotEvery = 4
+	defer func() { *walSnapshotEvery = old }()
+	sub, _ := CreateSubscription("compacted", SubscriptionOptions{})
+	for id := uint64(1); id <= 10; id++ {
+		pushAll(sub, id)
+	}
+	bs, err := ioutil.ReadFile(walPath("compacted"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(bs), "\n"); n >= *walSnapshotEvery {
+		t.Errorf("WAL holds %d records after compaction, want fewer than %d", n, *walSnapshotEvery)
+	}
+	loaded, err := loadSubscription("compacted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := backlog(loaded); len(got) != 10 {
+		t.Errorf("recovered backlog %v, want ids 1 to 10", got)
+	}
+}
+
+// BenchmarkRecovery measures loading a subscription with a 1M-message backlog from its snapshot plus a full WAL of changes since.
+func BenchmarkRecovery(b *testing.B) {
+	setUp(b)
+	const backlogSize = 1000000
+	snap := subscriptionSnapshot{Name: "big", UnAcked: make([]uint64, backlogSize)}
+	for i := range snap.UnAcked {
+		snap.UnAcked[i] = uint64(i)
+	}
+	if err := writeSnapshotFile("big", snap); err != nil {
+		b.Fatal(err)
+	}
+	var wal strings.Builder
+	for i := 0; i < *walSnapshotEvery; i++ {
+		fmt.Fprintf(&wal, "-%d\n+%d\n", i, backlogSize+i)
+	}
+	if err := ioutil.WriteFile(walPath("big"), []byte(wal.String()), 0644); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sub, err := loadSubscription("big")
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(sub.UnAcked) != backlogSize {
+			b.Fatalf("recovered %d messages, want %d", len(sub.UnAcked), backlogSize)
+		}
+	}
+}
+
+func TestCursorNeverMovesBackwards(t *testing.T) {
+	setUp(t)
+	sub, _ := CreateSubscription("forward", SubscriptionOptions{})
+	pushAll(sub, 5, 6, 7)
+	AckMessages([]uint64{7}, sub)
+	if sub.Cursor != 5 {
+		t.Fatalf("cursor %d with 5 unacked, want 5", sub.Cursor)
+	}
+	AckMessages([]uint64{5, 6}, sub)
+	if sub.Cursor != 8 {
+		t.Fatalf("cursor %d with everything acked, want 8", sub.Cursor)
+	}
+	// A replay puts back a message the cursor has passed.
+	pushAll(sub, 3)
+	if sub.Cursor != 8 {
+		t.Errorf("cursor moved back to %d after a replay, want 8", sub.Cursor)
+	}
+}
+
+func TestRestartDoesNotReuseRemovedIds(t *testing.T) {
+	setUp(t)
+	baseID, recipients, _ := CreateMessageIds(3, Routing{RejectBacklog: -1})
+	if err := PutMessages([]string{"a", "b", "c"}, nil, baseID, recipients); err != nil {
+		t.Fatal(err)
+	}
+	// The newest messages are reaped before the restart.
+	removeStoredMessage(1)
+	removeStoredMessage(2)
+	topic = &Topic{Name: "<default-topic>"}
+	if err := RecoverNextMessageID(); err != nil {
+		t.Fatal(err)
+	}
+	if topic.NextMesgID != 3 {
+		t.Errorf("next message id %d after restart, want 3", topic.NextMesgID)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var webhookURL = flag.String("webhook-url", "", "URL to POST to when a subscription's backlog crosses its high_watermark or recovers to its low_watermark")
+var watermarkInterval = flag.Duration("watermark-interval", 5*time.Second, "How often backlogs are checked against subscription watermarks")
+var callbackAllow = flag.String("callback-allow", "", "Comma-separated URL prefixes, such as https://hooks.example.com/receipts/, that receipt_url and notify_url must fall under; \"*\" allows any URL, and by default none is allowed")
+var notifyWorkers = flag.Int("notify-workers", 4, "Number of goroutines POSTing notify_url backlog notifications")
+var notifyQueue = flag.Int("notify-queue", 1000, "Number of backlog notifications that may wait for a worker; notifications beyond it are dropped")
+var webhookRetries = flag.Int("webhook-retries", 3, "Number of times a failed webhook or receipt POST is retried")
+
+const webhookRetryDelay = time.Second
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// WatermarkEvent is the JSON payload POSTed to the webhook.
+type WatermarkEvent struct {
+	Sub       string    `json:"sub"`
+	Depth     int       `json:"depth"`
+	Direction string    `json:"direction"` // "high" or "low".
+	Time      time.Time `json:"time"`
+}
+
+// CheckWatermarks compares each subscription's backlog with its watermarks and returns events for those that crossed one since the last check. high records which subscriptions are currently above their high watermark; it is updated in place. A subscription only fires "low" after it has fired "high", and vice versa, so a backlog hovering around one watermark cannot flap.
+func CheckWatermarks(high map[string]bool, now time.Time) []WatermarkEvent {
+	subsMu.RLock()
+	targets := make([]*Subscription, 0, len(subs))
+	for _, sub := range subs {
+		targets = append(targets, sub)
+	}
+	subsMu.RUnlock()
+
+	var events []WatermarkEvent
+	seen := make(map[string]bool, len(targets))
+	for _, sub := range targets {
+		stats := sub.Stats()
+		if stats.Options.HighWatermark == 0 {
+			continue
+		}
+		name := sub.Name()
+		seen[name] = true
+		switch {
+		case !high[name] && stats.Backlog >= stats.Options.HighWatermark:
+			high[name] = true
+			events = append(events, WatermarkEvent{name, stats.Backlog, "high", now})
+		case high[name] && stats.Backlog <= stats.Options.LowWatermark:
+			delete(high, name)
+			events = append(events, WatermarkEvent{name, stats.Backlog, "low", now})
+		}
+	}
+	for name := range high {
+		if !seen[name] {
+			delete(high, name)
+		}
+	}
+	return events
+}
+
+// checkCallbackURL returns an error unless s is an absolute http or https URL under one of the -callback-allow prefixes. A prefix matches URLs of the same scheme and host whose path starts with its path, so clients cannot make the server POST to arbitrary internal addresses.
+func checkCallbackURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return errors.New("not an absolute http or https URL")
+	}
+	for _, prefix := range strings.Split(*callbackAllow, ",") {
+		if prefix = strings.TrimSpace(prefix); prefix == "*" {
+			return nil
+		}
+		p, err := url.Parse(prefix)
+		if err != nil || prefix == "" {
+			continue
+		}
+		if p.Scheme == u.Scheme && strings.EqualFold(p.Host, u.Host) && strings.HasPrefix(u.Path, p.Path) {
+			return nil
+		}
+	}
+	return errors.New("not under any -callback-allow prefix")
+}
+
+// postJSON POSTs v as JSON to url, retrying with jittered exponential backoff. what describes the POST in log lines.
+func postJSON(url string, v interface{}, what string) error {
+	bs, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	delay := webhookRetryDelay
+	for attempt := 0; ; attempt++ {
+		err = func() error {
+			resp, err := webhookClient.Post(url, "application/json", bytes.NewReader(bs))
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+			if resp.StatusCode/100 != 2 {
+				return fmt.Errorf("webhook returned %s", resp.Status)
+			}
+			return nil
+		}()
+		if err == nil || attempt >= *webhookRetries {
+			return err
+		}
+		log.Printf("Retrying %s: %v", what, err)
+		time.Sleep(delay/2 + time.Duration(rand.Int63n(int64(delay))))
+		delay *= 2
+	}
+}
+
+// BacklogNotification is the JSON payload POSTed to a subscription's notify_url.
+type BacklogNotification struct {
+	Sub     string    `json:"sub"`
+	Backlog int       `json:"backlog"`
+	Time    time.Time `json:"time"`
+}
+
+type queuedNotification struct {
+	url          string
+	notification BacklogNotification
+}
+
+// notifyJobs feeds the notification workers. It is nil until StartNotifyWorkers.
+var notifyJobs chan queuedNotification
+
+// StartNotifyWorkers starts n goroutines POSTing backlog notifications, fed by a queue of the given size.
+func StartNotifyWorkers(n, size int) {
+	notifyJobs = make(chan queuedNotification, size)
+	for i := 0; i < n; i++ {
+		go func() {
+			for job := range notifyJobs {
+				what := fmt.Sprintf("backlog notification for %s", job.notification.Sub)
+				if err := postJSON(job.url, job.notification, what); err != nil {
+					log.Printf("Giving up on %s: %v", what, err)
+				}
+			}
+		}()
+	}
+}
+
+// notifyBacklog hands the workers a notification for sub's notify_url that its backlog is no longer empty, dropping it if they are too far behind.
+func notifyBacklog(url string, n BacklogNotification) {
+	select {
+	case notifyJobs <- queuedNotification{url, n}:
+	default:
+		log.Printf("Dropping backlog notification for %s: notification queue is full", n.Sub)
+	}
+}
+
+// StartWatermarkMonitor periodically checks backlogs against watermarks and reports crossings to url.
+func StartWatermarkMonitor(url string, interval time.Duration) {
+	high := make(map[string]bool)
+	go func() {
+		for now := range clock.Tick(interval) {
+			for _, event := range CheckWatermarks(high, now) {
+				log.Printf("Subscription %s backlog of %d crossed its %s watermark", event.Sub, event.Depth, event.Direction)
+				go func(event WatermarkEvent) {
+					what := fmt.Sprintf("%s webhook for %s", event.Direction, event.Sub)
+					if err := postJSON(url, event, what); err != nil {
+						log.Printf("Giving up on %s: %v", what, err)
+					}
+				}(event)
+			}
+		}
+	}()
+}